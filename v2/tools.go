@@ -2,17 +2,45 @@
 package webtoolkit
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
+	"math"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	"unicode"
 )
 
 // randomStringSource supplies the characters used to generate random strings
@@ -21,35 +49,264 @@ const randomStringSource = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ
 // Tools is used to instantiate this module. Any variable will have access
 // to all of the methods with the receiver *Tools
 type Tools struct {
-	MaxFileSize        int
-	AllowedFileTypes   []string
-	MaxJSONSize        int
+	// MaxFileSize is the largest file, in bytes, that the upload methods accept. Defaults to 1GB when zero
+	MaxFileSize int
+	// MaxTotalUploadSize, when set, is the most bytes that all of the files in a single request may add up to.
+	// Requests over the limit are rejected before any file is saved. UploadFilesFromField counts only the files
+	// in its field
+	MaxTotalUploadSize int
+	// MaxUploadMemory is how much of a multipart form, in bytes, is held in memory while parsing it, with the
+	// rest spilling to temporary files; it does not limit the size of uploads. Defaults to 32MB when zero
+	MaxUploadMemory int
+	// AllowedFileTypes lists the MIME types permitted for uploads, either exactly (e.g. "image/png") or by
+	// category (e.g. "image/*"). All types are permitted when empty
+	AllowedFileTypes []string
+	// DisallowedFileTypes lists MIME types, in the same form as AllowedFileTypes, that are always rejected for
+	// uploads, even when they are also allowed
+	DisallowedFileTypes []string
+	// ContentTypeDetector, when set, replaces http.DetectContentType for identifying the type of uploaded files,
+	// e.g. to use a more capable magic number library. It receives up to the first 512 bytes of the file
+	ContentTypeDetector func(data []byte, filename string) string
+	MaxJSONSize         int
+	// MaxJSONDepth, when set, limits how deeply objects and arrays may be nested in bodies read by ReadJSON,
+	// which guards against payloads that are small but expensive to decode. Zero means unlimited
+	MaxJSONDepth int
+	// MaxJSONStreamSize, when set, limits the whole body read by ReadJSONEach, which otherwise applies MaxJSONSize
+	// to each array element and places no limit on the number of elements
+	MaxJSONStreamSize int
+	// AllowUnknownFields causes ReadJSON and the helpers built on it to ignore JSON keys that have no matching
+	// struct field. By default they are rejected with an UnknownFieldError; see ReadJSONAllowUnknown to relax
+	// this for a single call
 	AllowUnknownFields bool
+	// UploadNameLength is the number of random characters in the names given to renamed uploads. Defaults
+	// to 25 when zero
+	UploadNameLength int
+	// NameGenerator, when set, names renamed uploads instead of the random names, e.g. with a hash of the content
+	// or a tenant prefix. It receives the client's file name and the detected content type. Directories in the
+	// result are dropped, the original extension is added when missing, and a name that is already taken gets a
+	// random suffix. UploadNamePrefix and UploadNameLength are not applied
+	NameGenerator func(original string, fileType string) string
+	// UploadNamePrefix is prepended to the names given to renamed uploads, e.g. "avatar_"
+	UploadNamePrefix string
+	// BaseUploadDir, when set, is the directory all upload directories must be inside. Uploads to a directory
+	// that resolves to somewhere outside of it (e.g. via "../") are rejected
+	BaseUploadDir string
+	// DateBasedUploadPath causes uploads to be saved in year/month/day subdirectories of the upload directory,
+	// e.g. uploadDir/2024/06/12/, which are created as needed
+	DateBasedUploadPath bool
+	// UploadConcurrency is how many files UploadFiles, UploadFilesFromField, UploadFilesWithOptions, and
+	// UploadFilesTo process at once. Values above 1 keep going after a failed file and report every failure in an
+	// UploadErrors, and require any Logger or RandReader to be safe for concurrent use. Files are processed one at
+	// a time when zero
+	UploadConcurrency int
+	// DurableUploads causes saved uploads, and the directories holding them, to be synced to stable storage
+	// before the upload methods return, so an acknowledged file survives a crash. Each sync waits for the disk,
+	// which can slow uploads considerably, especially of many small files
+	DurableUploads bool
+	// ResumableUploadDir holds the metadata of the uploads started by CreateUpload, so they can be resumed after
+	// a restart. Defaults to a webtoolkit-uploads directory in os.TempDir()
+	ResumableUploadDir string
+	// ResumableUploadTTL is how long an unfinished resumable upload is kept after its last chunk arrived before
+	// it is deleted. Defaults to 24 hours. It is saved with each upload when CreateUpload starts it, so other
+	// Tools sharing ResumableUploadDir expire the upload by this TTL rather than by their own
+	ResumableUploadTTL time.Duration
+	// ProgressFunc, when set, is called as the upload methods read each file, with the bytes read so far and the
+	// size of the file sent by the client, or of the re-encoded image when StripImageMetadata applies, e.g. to
+	// report progress over a websocket. With UploadConcurrency above 1 it may be called from several goroutines
+	// at once
+	ProgressFunc func(filename string, bytesWritten, totalBytes int64)
+	// MaxBodySize limits the size of request bodies read by ReadString and ReadForm. Defaults to 1MB when zero
+	MaxBodySize int
+	// FullyDecodeImages causes UploadFiles to decode every uploaded GIF, JPEG, or PNG image in full,
+	// rejecting truncated or corrupt files. This is considerably more expensive than the content type check
+	FullyDecodeImages bool
+	// ImageConstraints limits the dimensions of uploaded GIF, JPEG, and PNG images. Other files are not checked
+	ImageConstraints ImageConstraints
+	// StripImageMetadata causes uploaded JPEG and PNG images to be decoded and re-encoded before they are saved,
+	// dropping metadata such as EXIF GPS coordinates. JPEG images are re-encoded at quality 90, so some image
+	// quality is lost
+	StripImageMetadata bool
+	// RemoteTimeout limits how long requests to remote services may take when no http.Client is supplied.
+	// The zero value means no timeout, which matches the behavior of the standard http.Client
+	RemoteTimeout time.Duration
+	// RandReader is the source of randomness for RandomBytes and the helpers built on it. When nil,
+	// crypto/rand.Reader is used
+	RandReader io.Reader
+	// ErrorContextFunc, when set, supplies fields (e.g. a request or trace ID) that ErrorJSONForRequest
+	// includes in the meta field of every error response
+	ErrorContextFunc func(r *http.Request) map[string]string
+	// CORS configures the cross-origin requests allowed by CORSMiddleware
+	CORS CORSConfig
+	// RateLimit configures the per-client limits applied by RateLimitMiddleware
+	RateLimit RateLimitConfig
+	// SecurityHeaders configures the headers set by SecurityHeadersMiddleware
+	SecurityHeaders SecurityHeadersConfig
+	// DefaultResponseHeaders are added to every response written by WriteJSON and the other response helpers,
+	// e.g. Cache-Control or Vary. Headers passed to an individual call replace defaults with the same key, while
+	// defaults never replace headers already set by middleware. Vary values are merged rather than replaced
+	DefaultResponseHeaders http.Header
+	// GzipMinSize is the smallest JSON body, in bytes, that WriteJSONCompressed compresses. Defaults to 1024
+	// when zero
+	GzipMinSize int
+	// GzipLevel is the compression level used by WriteJSONCompressed, e.g. gzip.BestSpeed. Zero, or any level
+	// gzip does not accept, means gzip.DefaultCompression
+	GzipLevel int
+	// Logger, when set, receives events from uploads and pushes to remote services, such as file sizes, status
+	// codes, and latencies. Nothing is logged when nil
+	Logger Logger
+	// Metrics, when set, is told about every response written by WriteJSON, and so by ErrorJSON and the other
+	// helpers built on it. Nothing is recorded when nil
+	Metrics Metrics
+
+	// uploadNow, uploadRandomString, and uploadSync stand in for time.Now, RandomString, and (*os.File).Sync in
+	// the upload methods when set, so tests can fix the date, force name collisions, and observe syncs
+	uploadNow          func() time.Time
+	uploadRandomString func(n int) string
+	uploadSync         func(f *os.File) error
+}
+
+// Logger is the minimal structured logger used by Tools. Each event has a message followed by alternating
+// keys and values, which suits adapters for most logging packages
+type Logger interface {
+	Info(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Metrics receives measurements of responses, e.g. to feed Prometheus counters and histograms, without this
+// module depending on a metrics library
+type Metrics interface {
+	// ObserveResponse is called with the status sent, the number of body bytes written, and how long encoding
+	// and writing the response took
+	ObserveResponse(status int, size int, dur time.Duration)
+}
+
+// logInfo sends an informational event to the Logger, if one is set
+func (t *Tools) logInfo(msg string, keyvals ...interface{}) {
+	if t.Logger != nil {
+		t.Logger.Info(msg, keyvals...)
+	}
+}
+
+// logError sends an error event to the Logger, if one is set
+func (t *Tools) logError(msg string, keyvals ...interface{}) {
+	if t.Logger != nil {
+		t.Logger.Error(msg, keyvals...)
+	}
 }
 
 // RandomString returns a string of random characters of length n, using
 // randomStringSource as the source for the string
 func (t *Tools) RandomString(n int) string {
-	randString, charSource := make([]rune, n), []rune(randomStringSource)
+	return randomStringFrom(n, randomStringSource)
+}
+
+// CharsetPreset is a named alphabet for RandomStringWithCharset
+type CharsetPreset string
+
+// Alphabets available to RandomStringWithCharset
+const (
+	// CharsetNumeric suits one-time passcodes
+	CharsetNumeric CharsetPreset = "0123456789"
+	// CharsetLowerAlpha suits case-insensitive codes, e.g. invite codes
+	CharsetLowerAlpha CharsetPreset = "abcdefghijklmnopqrstuvwxyz"
+	// CharsetAlphaNumeric is letters of either case and digits
+	CharsetAlphaNumeric CharsetPreset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	// CharsetUnambiguous leaves out the easily confused 0, O, 1, l, and I, for codes people read or type
+	CharsetUnambiguous CharsetPreset = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// ErrEmptyCharset is returned by RandomStringWithCharset when the alphabet has no characters to draw from
+var ErrEmptyCharset = errors.New("the charset must not be empty")
+
+// RandomStringWithCharset returns a string of random characters of length n, drawn from the alphabet of preset.
+// ErrEmptyCharset is returned for an empty preset
+func (t *Tools) RandomStringWithCharset(n int, preset CharsetPreset) (string, error) {
+	if preset == "" {
+		return "", ErrEmptyCharset
+	}
+
+	return randomStringFrom(n, string(preset)), nil
+}
+
+// randomStringFrom returns a string of n characters chosen uniformly at random from source
+func randomStringFrom(n int, source string) string {
+	randString, charSource := make([]rune, n), []rune(source)
+	size := big.NewInt(int64(len(charSource)))
 
 	for i := range randString {
-		p, _ := rand.Prime(rand.Reader, len(charSource))
-		x, y := p.Uint64(), uint64(len(charSource))
-		randString[i] = charSource[x%y]
+		x, _ := rand.Int(rand.Reader, size)
+		randString[i] = charSource[x.Int64()]
 	}
 
 	return string(randString)
 }
 
+// RandomBytes returns n bytes read from RandReader, or crypto/rand if none is set
+func (t *Tools) RandomBytes(n int) ([]byte, error) {
+	b := make([]byte, n)
+
+	if _, err := io.ReadFull(t.randReader(), b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// RandomHex returns n random bytes encoded as a hexadecimal string of length 2n. An error is
+// returned if the random bytes cannot be read
+func (t *Tools) RandomHex(n int) (string, error) {
+	b, err := t.RandomBytes(n)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// RandomURLSafe returns n random bytes encoded as unpadded, URL safe base64. An error is
+// returned if the random bytes cannot be read
+func (t *Tools) RandomURLSafe(n int) (string, error) {
+	b, err := t.RandomBytes(n)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// GenerateToken returns a token suitable for password reset or email verification links, made of byteLen
+// random bytes encoded as unpadded, URL safe base64. The token carries 8 * byteLen bits of entropy, so 32
+// bytes (256 bits) is a sensible choice for security tokens
+func (t *Tools) GenerateToken(byteLen int) (string, error) {
+	b, err := t.RandomBytes(byteLen)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// randReader returns the configured source of randomness, defaulting to crypto/rand
+func (t *Tools) randReader() io.Reader {
+	if t.RandReader != nil {
+		return t.RandReader
+	}
+
+	return rand.Reader
+}
+
 // UploadedFile is used to save information about an uploaded file.
 type UploadedFile struct {
 	NewFileName      string
 	OriginalFileName string
 	FileSize         int64
+	// Path is the location of the file relative to the upload directory, using forward slashes, e.g.
+	// "2024/06/12/<NewFileName>" with DateBasedUploadPath. It is the same as NewFileName otherwise
+	Path string
 }
 
 // UploadOneFile is a convenience method that calls UploadFiles, but expects only one file.
-// It returns an UploadedFile and potentially an error.
+// It returns an UploadedFile and potentially an error, which is ErrNoFiles if no file was uploaded.
 // If the optional last parameter is set to `false` we will not rename the file(s) but keep the original
 // filename.
 func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool) (*UploadedFile, error) {
@@ -67,6 +324,10 @@ func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool)
 		return nil, err
 	}
 
+	if len(files) == 0 {
+		return nil, ErrNoFiles
+	}
+
 	return files[0], nil
 }
 
@@ -74,6 +335,8 @@ func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool)
 // It returns a slice of UploadedFile and potentially an error.
 // If the optional last parameter is set to `false` we will not rename the file(s) but keep the original
 // filename.
+// Any temporary files created while parsing the multipart form are removed before returning, so the files
+// in a request can only be uploaded once. ErrNoFiles is returned if the request contains no files.
 func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
 	renameFile := true
 	if t.MaxFileSize == 0 {
@@ -84,266 +347,4471 @@ func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) (
 		renameFile = rename[0]
 	}
 
-	var uploadedFiles []*UploadedFile
-
-	err := r.ParseMultipartForm(int64(t.MaxFileSize))
-	if err != nil {
-		return nil, errors.New("the uploaded file is too large")
-	}
-
-	err = t.CreateDirIfNotExists(uploadDir)
+	err := t.prepareUpload(r, uploadDir, "")
 	if err != nil {
-		return nil, errors.New("cannot create/utilize upload directory")
+		return nil, err
 	}
+	defer r.MultipartForm.RemoveAll()
 
-	for _, fileHeaders := range r.MultipartForm.File {
-		for _, fileHeader := range fileHeaders {
-			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
-				var uploadedFile UploadedFile
+	return t.uploadEach(formFileHeaders(r.MultipartForm), func(fileHeader *multipart.FileHeader) (*UploadedFile, error) {
+		return t.uploadFile(fileHeader, uploadDir, renameFile)
+	})
+}
 
-				infile, err := fileHeader.Open()
-				if err != nil {
-					return nil, err
-				}
-				defer infile.Close()
+// UploadErrors is returned when UploadConcurrency is above 1 and one or more files fail to upload. It holds
+// one error per failed file, in the order the files appear in the form
+type UploadErrors []error
 
-				// check to see if the file type is permitted
-				buff := make([]byte, 512)
-				_, err = infile.Read(buff)
-				if err != nil {
-					return nil, err
-				}
+// Error joins the messages of every failed upload
+func (e UploadErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.Error()
+	}
 
-				allowed := false
-				fileType := http.DetectContentType(buff)
+	return fmt.Sprintf("%d files failed to upload: %s", len(e), strings.Join(msgs, "; "))
+}
 
-				if len(t.AllowedFileTypes) > 0 {
-					for _, x := range t.AllowedFileTypes {
-						if strings.EqualFold(x, fileType) {
-							allowed = true
-							break
-						}
-					}
-				} else {
-					allowed = true
-				}
+// Errors returns the individual upload errors
+func (e UploadErrors) Errors() []error {
+	return e
+}
 
-				if !allowed {
-					return nil, errors.New(fmt.Sprintf("files of type '%s' are not allowed", fileType))
-				}
+// Is reports whether any of the upload errors matches target, so errors.Is can look inside UploadErrors
+func (e UploadErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
 
-				// we're good, so rewind
-				_, err = infile.Seek(0, 0)
-				if err != nil {
-					return nil, err
-				}
+	return false
+}
 
-				uploadedFile.OriginalFileName = fileHeader.Filename
+// As finds the first upload error that matches target, so errors.As can look inside UploadErrors
+func (e UploadErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
 
-				if renameFile {
-					uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(fileHeader.Filename))
-				} else {
-					uploadedFile.NewFileName = fileHeader.Filename
-				}
+	return false
+}
 
-				var outfile *os.File
-				defer outfile.Close()
+// formFileHeaders collects every file in a multipart form into a slice, ordered by field name and then by
+// the order of the files within each field
+func formFileHeaders(form *multipart.Form) []*multipart.FileHeader {
+	fields := make([]string, 0, len(form.File))
+	for field := range form.File {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
 
-				if outfile, err = os.Create(filepath.Join(uploadDir, uploadedFile.NewFileName)); err != nil {
-					return nil, err
-				} else {
-					fileSize, err := io.Copy(outfile, infile)
-					if err != nil {
-						return nil, err
-					}
+	var fileHeaders []*multipart.FileHeader
+	for _, field := range fields {
+		fileHeaders = append(fileHeaders, form.File[field]...)
+	}
 
-					uploadedFile.FileSize = fileSize
-				}
+	return fileHeaders
+}
 
-				uploadedFiles = append(uploadedFiles, &uploadedFile)
+// uploadEach calls upload for every file, using up to UploadConcurrency workers. Processing one file at a
+// time stops at the first error; otherwise every file is attempted and the failures are returned as
+// UploadErrors. Either way the files that were saved are returned in the same order as fileHeaders.
+func (t *Tools) uploadEach(fileHeaders []*multipart.FileHeader, upload func(fileHeader *multipart.FileHeader) (*UploadedFile, error)) ([]*UploadedFile, error) {
+	var uploadedFiles []*UploadedFile
 
-				return uploadedFiles, nil
-			}(uploadedFiles)
+	if t.UploadConcurrency <= 1 || len(fileHeaders) <= 1 {
+		for _, fileHeader := range fileHeaders {
+			uploadedFile, err := upload(fileHeader)
+			if uploadedFile != nil {
+				uploadedFiles = append(uploadedFiles, uploadedFile)
+			}
 
 			if err != nil {
 				return uploadedFiles, err
 			}
 		}
+
+		return uploadedFiles, nil
 	}
 
-	return uploadedFiles, nil
-}
+	workers := t.UploadConcurrency
+	if workers > len(fileHeaders) {
+		workers = len(fileHeaders)
+	}
+
+	results := make([]*UploadedFile, len(fileHeaders))
+	errs := make([]error, len(fileHeaders))
+	indexes := make(chan int)
 
-// CreateDirIfNotExists creates a directory and all necessary parents if they do not exist
-func (t *Tools) CreateDirIfNotExists(path string) error {
-	const mode = 0755
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				results[i], errs[i] = upload(fileHeaders[i])
+			}
+		}()
+	}
+
+	for i := range fileHeaders {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	var uploadErrs UploadErrors
+	for i, err := range errs {
+		if results[i] != nil {
+			uploadedFiles = append(uploadedFiles, results[i])
+		}
 
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err := os.MkdirAll(path, mode)
 		if err != nil {
-			return err
+			uploadErrs = append(uploadErrs, err)
 		}
 	}
 
-	return nil
+	if len(uploadErrs) > 0 {
+		return uploadedFiles, uploadErrs
+	}
+
+	return uploadedFiles, nil
 }
 
-// Slugify converts string s into a URL safe slug
-func (t *Tools) Slugify(s string) (string, error) {
-	if strings.Trim(s, " ") == "" {
-		return "", errors.New("empty string not permitted")
+// UploadOptions adjusts how UploadFilesWithOptions saves files
+type UploadOptions struct {
+	// KeepOriginalName saves files under the name supplied by the client instead of a random name
+	KeepOriginalName bool
+	// ModTime, when set, returns the modification time to give the saved copy of each file, e.g. one taken from
+	// a form field or EXIF data. A zero time leaves the file with the time it was saved
+	ModTime func(fileHeader *multipart.FileHeader) time.Time
+}
+
+// UploadFilesWithOptions uploads files exactly like UploadFiles, with the behavior adjusted by opts
+func (t *Tools) UploadFilesWithOptions(r *http.Request, uploadDir string, opts UploadOptions) ([]*UploadedFile, error) {
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1024 * 1024 * 1024
 	}
 
-	var re = regexp.MustCompile(`[^a-z\d]+`)
-	slug := strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
-	if len(slug) == 0 {
-		return "", errors.New("removing non-characters returns zero length slug")
+	err := t.prepareUpload(r, uploadDir, "")
+	if err != nil {
+		return nil, err
 	}
+	defer r.MultipartForm.RemoveAll()
 
-	return slug, nil
+	return t.uploadEach(formFileHeaders(r.MultipartForm), func(fileHeader *multipart.FileHeader) (*UploadedFile, error) {
+		uploadedFile, err := t.uploadFile(fileHeader, uploadDir, !opts.KeepOriginalName)
+		if err != nil || opts.ModTime == nil {
+			return uploadedFile, err
+		}
+
+		if modTime := opts.ModTime(fileHeader); !modTime.IsZero() {
+			err = os.Chtimes(filepath.Join(uploadDir, filepath.FromSlash(uploadedFile.Path)), modTime, modTime)
+			if err != nil {
+				return uploadedFile, err
+			}
+		}
+
+		return uploadedFile, nil
+	})
 }
 
-// DownloadStaticFile sends file to the client and attempts to force the browser to download the file,
-// saving it as the value provided in the displayName parameter
-func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
-	if _, err := os.Stat(pathName); os.IsNotExist(err) {
-		http.Error(w, err.Error(), http.StatusNotFound)
+// UploadFilesFromField uploads only the files submitted under the named form field, leaving files in any
+// other field untouched. Otherwise it behaves exactly like UploadFiles, including removing the temporary
+// files of the whole form, so to handle several fields use UploadFilesToMemory or a single UploadFiles call.
+// ErrNoFiles is returned if the named field holds no files, even when other fields do.
+func (t *Tools) UploadFilesFromField(r *http.Request, fieldName, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	renameFile := true
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1024 * 1024 * 1024
 	}
 
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
 
-	http.ServeFile(w, r, pathName)
-}
+	err := t.prepareUpload(r, uploadDir, fieldName)
+	if err != nil {
+		return nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
 
-// JSONResponse is used to relay JSON payloads
-type JSONResponse struct {
-	Error   bool        `json:"error"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+	return t.uploadEach(r.MultipartForm.File[fieldName], func(fileHeader *multipart.FileHeader) (*UploadedFile, error) {
+		return t.uploadFile(fileHeader, uploadDir, renameFile)
+	})
 }
 
-// ReadJSON attempts to convert the body of a request from JSON into a go data variable
-func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
-	// try to prevent malicious content size
-	maxBytes := 1024 * 1024
-	if t.MaxJSONSize != 0 {
-		maxBytes = t.MaxJSONSize
+// checkUploadDir makes sure uploadDir is within BaseUploadDir, if one is set
+func (t *Tools) checkUploadDir(uploadDir string) error {
+	if t.BaseUploadDir == "" {
+		return nil
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+	base, err := filepath.Abs(t.BaseUploadDir)
+	if err != nil {
+		return err
+	}
 
-	dec := json.NewDecoder(r.Body)
-	if !t.AllowUnknownFields {
-		dec.DisallowUnknownFields()
+	dir, err := filepath.Abs(uploadDir)
+	if err != nil {
+		return err
 	}
 
-	err := dec.Decode(data)
+	rel, err := filepath.Rel(base, dir)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("upload directory '%s' is outside of the base upload directory", uploadDir)
+	}
+
+	return nil
+}
+
+// InMemoryFile holds an uploaded file that has been read into memory rather than saved to disk
+type InMemoryFile struct {
+	OriginalFileName string
+	FileType         string
+	FileSize         int64
+	Data             []byte
+}
+
+// UploadFilesToMemory reads every file in the multipart form into memory instead of saving it to disk, which
+// suits read-only or serverless environments and proxying uploads elsewhere. The same AllowedFileTypes and
+// MaxFileSize rules as UploadFiles apply, and files are read in the same order, honoring UploadConcurrency
+// and reporting to Logger just as UploadFiles does.
+func (t *Tools) UploadFilesToMemory(r *http.Request) ([]*InMemoryFile, error) {
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1024 * 1024 * 1024
+	}
+
+	err := t.ValidateConfig()
 	if err != nil {
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
-		unknownFieldErr := "json: unknown field"
+		return nil, err
+	}
 
-		switch {
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly formed JSON at character %d", syntaxError.Offset)
+	err = parseUploadForm(r, t.uploadMemory(), int64(t.MaxTotalUploadSize), "")
+	if err != nil {
+		return nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	fileHeaders := formFileHeaders(r.MultipartForm)
+
+	// each file is read into its own slot, so the results keep the order of fileHeaders whatever the concurrency
+	positions := make(map[*multipart.FileHeader]int, len(fileHeaders))
+	for i, fileHeader := range fileHeaders {
+		positions[fileHeader] = i
+	}
+	read := make([]*InMemoryFile, len(fileHeaders))
 
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+	_, err = t.uploadEach(fileHeaders, func(fileHeader *multipart.FileHeader) (*UploadedFile, error) {
+		return t.logUpload(fileHeader, func() (*UploadedFile, error) {
+			file, err := t.readFileToMemory(fileHeader)
+			if err != nil {
+				return nil, err
 			}
-			return fmt.Errorf("body contains incorrect JSON at character %d", unmarshalTypeError.Offset)
 
-		case errors.As(err, &invalidUnmarshalError):
-			return fmt.Errorf("error unmarshalling JSON: %s", err.Error())
+			read[positions[fileHeader]] = file
+
+			return &UploadedFile{OriginalFileName: file.OriginalFileName, FileSize: file.FileSize}, nil
+		})
+	})
 
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly formed JSON (unexpected EOF)")
+	var files []*InMemoryFile
+	for _, file := range read {
+		if file != nil {
+			files = append(files, file)
+		}
+	}
 
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+	return files, err
+}
 
-		case strings.HasPrefix(err.Error(), unknownFieldErr):
-			fieldname := strings.TrimPrefix(err.Error(), unknownFieldErr)
-			return fmt.Errorf("body contains unknown key %s", fieldname)
+// readFileToMemory checks that a single file from a multipart form is permitted, and reads it into memory
+func (t *Tools) readFileToMemory(fileHeader *multipart.FileHeader) (*InMemoryFile, error) {
+	err := t.checkFileSize(fileHeader)
+	if err != nil {
+		return nil, err
+	}
 
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+	infile, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer infile.Close()
 
-		default:
-			return err
-		}
+	fileType, err := t.checkFileType(infile, fileHeader.Filename)
+	if err != nil {
+		return nil, err
 	}
 
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		return errors.New("body must not contain more than one JSON payload")
+	src, err := t.stripImageMetadata(infile, fileType, fileHeader.Filename)
+	if err != nil {
+		return nil, err
 	}
+	src = t.reportProgress(src, fileHeader)
 
-	return nil
+	data, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	return &InMemoryFile{
+		OriginalFileName: fileHeader.Filename,
+		FileType:         fileType,
+		FileSize:         int64(len(data)),
+		Data:             data,
+	}, nil
 }
 
-// WriteJSON takes a response status and arbitrary data and writes JSON to the client
-func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
-	out, err := json.Marshal(data)
+// ErrNoFiles is returned by the upload methods when a request contains no files
+var ErrNoFiles = errors.New("no files in request")
+
+// parseUploadForm parses the multipart form in r, returning ErrNoFiles if it holds no files at all. When maxTotal
+// is above zero, a form whose files add up to more than maxTotal bytes is rejected before any are saved. Only
+// the files in fieldName are counted, unless it is empty
+func parseUploadForm(r *http.Request, maxMemory, maxTotal int64, fieldName string) error {
+	err := r.ParseMultipartForm(maxMemory)
+	if errors.Is(err, io.EOF) {
+		return ErrNoFiles
+	}
 	if err != nil {
-		return err
+		return errors.New("the uploaded file is too large")
 	}
 
-	if len(headers) > 0 {
-		for key, value := range headers[0] {
-			w.Header()[key] = value
-		}
+	if r.MultipartForm == nil {
+		return ErrNoFiles
 	}
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
 
-	_, err = w.Write(out)
-	if err != nil {
-		return err
+	if len(r.MultipartForm.File) == 0 || (fieldName != "" && len(r.MultipartForm.File[fieldName]) == 0) {
+		_ = r.MultipartForm.RemoveAll()
+		return ErrNoFiles
+	}
+
+	if maxTotal > 0 {
+		fileHeaders := r.MultipartForm.File[fieldName]
+		if fieldName == "" {
+			fileHeaders = formFileHeaders(r.MultipartForm)
+		}
+
+		var total int64
+		for _, fileHeader := range fileHeaders {
+			total += fileHeader.Size
+		}
+
+		if total > maxTotal {
+			_ = r.MultipartForm.RemoveAll()
+			return fmt.Errorf("the uploaded files total %d bytes, which is more than the limit of %d bytes", total, maxTotal)
+		}
 	}
 
 	return nil
 }
 
-// ErrorJSON takes an error and optionally a status code, and sends a formatted JSON error
-func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
-	statusCode := http.StatusBadRequest
-	if len(status) > 0 {
-		statusCode = status[0]
+// uploadMemory returns the memory limit to use when parsing a multipart form
+func (t *Tools) uploadMemory() int64 {
+	if t.MaxUploadMemory > 0 {
+		return int64(t.MaxUploadMemory)
 	}
 
-	var payload JSONResponse
-	payload.Error = true
-	payload.Message = err.Error()
+	return 32 << 20
+}
 
-	return t.WriteJSON(w, statusCode, payload)
+// checkFileSize makes sure a single file from a multipart form is no larger than MaxFileSize
+func (t *Tools) checkFileSize(fileHeader *multipart.FileHeader) error {
+	if t.MaxFileSize > 0 && fileHeader.Size > int64(t.MaxFileSize) {
+		return fmt.Errorf("the uploaded file '%s' is too large", fileHeader.Filename)
+	}
+
+	return nil
 }
 
-// PushJSONToRemote posts arbitrary JSON data to the specified uri and returns the response, status code, and error.
-// The standard http.Client is used unless an optional one is supplied in the optional client parameter.
-func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
-	payload, err := json.Marshal(data)
+// prepareUpload parses the multipart form in r and makes sure the upload directory exists. fieldName names the
+// only field whose files will be saved, or is empty when every file will be
+func (t *Tools) prepareUpload(r *http.Request, uploadDir, fieldName string) error {
+	err := t.ValidateConfig()
 	if err != nil {
-		return nil, http.StatusBadRequest, err
+		return err
 	}
 
-	httpClient := &http.Client{}
-	if len(client) > 0 {
-		httpClient = client[0]
+	err = t.checkUploadDir(uploadDir)
+	if err != nil {
+		return err
 	}
 
-	req, err := http.NewRequest("POST", uri, bytes.NewBuffer(payload))
+	err = parseUploadForm(r, t.uploadMemory(), int64(t.MaxTotalUploadSize), fieldName)
 	if err != nil {
-		return nil, http.StatusBadRequest, err
+		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
 
-	res, err := httpClient.Do(req)
+	err = t.CreateDirIfNotExists(uploadDir)
 	if err != nil {
-		return nil, http.StatusBadRequest, err
+		_ = r.MultipartForm.RemoveAll()
+		return errors.New("cannot create/utilize upload directory")
 	}
-	defer res.Body.Close()
 
-	return res, res.StatusCode, nil
+	return nil
+}
+
+// checkFileType sniffs the content type of an uploaded file and makes sure it is permitted, leaving the
+// file rewound to the start. It returns the detected content type
+func (t *Tools) checkFileType(infile io.ReadSeeker, filename string) (string, error) {
+	// check to see if the file type is permitted, sniffing only what was read for files under 512 bytes
+	buff := make([]byte, 512)
+	n, err := io.ReadFull(infile, buff)
+	if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return "", err
+	}
+
+	fileType, err := t.detectFileType(buff[:n], filename)
+	if err != nil {
+		return "", err
+	}
+
+	// we're good, so rewind
+	_, err = infile.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	if t.FullyDecodeImages && strings.HasPrefix(fileType, "image/") {
+		// image formats the standard library cannot decode are left unchecked
+		if _, _, err = image.Decode(infile); err != nil && !errors.Is(err, image.ErrFormat) {
+			return "", fmt.Errorf("the uploaded image '%s' is corrupt or truncated", filename)
+		}
+
+		_, err = infile.Seek(0, 0)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if t.ImageConstraints != (ImageConstraints{}) && strings.HasPrefix(fileType, "image/") {
+		// only the header is read, so this is cheap even for large images
+		config, _, err := image.DecodeConfig(infile)
+		if err != nil && !errors.Is(err, image.ErrFormat) {
+			return "", fmt.Errorf("the uploaded image '%s' is corrupt or truncated", filename)
+		}
+
+		if err == nil {
+			err = t.ImageConstraints.check(config.Width, config.Height)
+			if err != nil {
+				return "", fmt.Errorf("the uploaded image '%s' %s", filename, err.Error())
+			}
+		}
+
+		_, err = infile.Seek(0, 0)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return fileType, nil
+}
+
+// ImageConstraints are the limits on the dimensions, in pixels, of uploaded images. A zero limit is not checked
+type ImageConstraints struct {
+	MinWidth  int
+	MinHeight int
+	MaxWidth  int
+	MaxHeight int
+	// RequireSquare rejects images whose width and height differ, e.g. for avatars
+	RequireSquare bool
+}
+
+// check returns an error describing the first constraint an image of the given size violates
+func (c ImageConstraints) check(width, height int) error {
+	switch {
+	case c.MinWidth > 0 && width < c.MinWidth:
+		return fmt.Errorf("is %d pixels wide, but must be at least %d", width, c.MinWidth)
+	case c.MinHeight > 0 && height < c.MinHeight:
+		return fmt.Errorf("is %d pixels high, but must be at least %d", height, c.MinHeight)
+	case c.MaxWidth > 0 && width > c.MaxWidth:
+		return fmt.Errorf("is %d pixels wide, but must be at most %d", width, c.MaxWidth)
+	case c.MaxHeight > 0 && height > c.MaxHeight:
+		return fmt.Errorf("is %d pixels high, but must be at most %d", height, c.MaxHeight)
+	case c.RequireSquare && width != height:
+		return fmt.Errorf("is %dx%d pixels, but must be square", width, height)
+	}
+
+	return nil
+}
+
+// detectFileType identifies a file from up to its first 512 bytes, returning an error if the type is not
+// permitted by AllowedFileTypes and DisallowedFileTypes
+func (t *Tools) detectFileType(head []byte, filename string) (string, error) {
+	var fileType string
+	if t.ContentTypeDetector != nil {
+		fileType = t.ContentTypeDetector(head, filename)
+	} else {
+		fileType = http.DetectContentType(head)
+	}
+
+	allowed := len(t.AllowedFileTypes) == 0 || matchesFileType(fileType, t.AllowedFileTypes)
+	if matchesFileType(fileType, t.DisallowedFileTypes) {
+		allowed = false
+	}
+
+	if !allowed {
+		return "", errors.New(fmt.Sprintf("files of type '%s' are not allowed", fileType))
+	}
+
+	return fileType, nil
+}
+
+// matchesFileType reports whether fileType matches any of the patterns, which are either exact MIME types
+// such as "image/png" or whole categories such as "image/*". Parameters like "; charset=utf-8" are ignored
+// unless the pattern includes them
+func matchesFileType(fileType string, patterns []string) bool {
+	mediaType, _, _ := strings.Cut(fileType, ";")
+	mediaType = strings.TrimSpace(mediaType)
+	category, _, _ := strings.Cut(mediaType, "/")
+
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+
+		if strings.EqualFold(pattern, fileType) || strings.EqualFold(pattern, mediaType) {
+			return true
+		}
+
+		if strings.HasSuffix(pattern, "/*") && strings.EqualFold(strings.TrimSuffix(pattern, "/*"), category) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ErrInvalidConfig is matched by every error returned by ValidateConfig
+var ErrInvalidConfig = errors.New("tools configuration is invalid")
+
+// ConfigError is returned by ValidateConfig when a configuration field holds an unusable value
+type ConfigError struct {
+	Field string
+	Value string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("%s contains %q, which is not a MIME type such as \"image/jpeg\" or \"image/*\"", e.Field, e.Value)
+}
+
+func (e *ConfigError) Unwrap() error {
+	return ErrInvalidConfig
+}
+
+// ValidateConfig checks the configured AllowedFileTypes and DisallowedFileTypes, returning a *ConfigError
+// naming the first entry that is not a MIME type, e.g. "jpeg" instead of "image/jpeg". The upload methods call
+// it before reading any files, so a misconfiguration is reported as such rather than rejecting every upload
+func (t *Tools) ValidateConfig() error {
+	lists := []struct {
+		field string
+		types []string
+	}{
+		{field: "AllowedFileTypes", types: t.AllowedFileTypes},
+		{field: "DisallowedFileTypes", types: t.DisallowedFileTypes},
+	}
+
+	for _, list := range lists {
+		for _, fileType := range list.types {
+			if !validFileTypePattern(fileType) {
+				return &ConfigError{Field: list.field, Value: fileType}
+			}
+		}
+	}
+
+	return nil
+}
+
+// validFileTypePattern reports whether pattern is a MIME type, or a category such as "image/*", in the form
+// that matchesFileType expects
+func validFileTypePattern(pattern string) bool {
+	mediaType, _, err := mime.ParseMediaType(pattern)
+	if err != nil {
+		return false
+	}
+
+	category, subtype, found := strings.Cut(mediaType, "/")
+
+	return found && category != "" && category != "*" && subtype != "" && !strings.Contains(subtype, "/")
+}
+
+// maxNameAttempts is how many random names are tried for a renamed upload before giving up on collisions
+const maxNameAttempts = 5
+
+// uploadTime returns the date used by DateBasedUploadPath
+func (t *Tools) uploadTime() time.Time {
+	if t.uploadNow != nil {
+		return t.uploadNow()
+	}
+
+	return time.Now()
+}
+
+// uploadRandom generates the random part of renamed upload file names
+func (t *Tools) uploadRandom(n int) string {
+	if t.uploadRandomString != nil {
+		return t.uploadRandomString(n)
+	}
+
+	return t.RandomString(n)
+}
+
+// syncFile flushes a saved upload, or its directory, to stable storage for DurableUploads
+func (t *Tools) syncFile(f *os.File) error {
+	if t.uploadSync != nil {
+		return t.uploadSync(f)
+	}
+
+	return f.Sync()
+}
+
+// uploadFileName returns the name to save an upload as: originalName, or when renameFile is set, the name from
+// NameGenerator or a random name with the same extension. attempt counts the names tried so far, so a generated
+// name that collides gets a random suffix
+func (t *Tools) uploadFileName(originalName, fileType string, renameFile bool, attempt int) string {
+	if !renameFile {
+		return originalName
+	}
+
+	if t.NameGenerator != nil {
+		if name := generatedFileName(t.NameGenerator(originalName, fileType), originalName); name != "" {
+			if attempt > 1 {
+				ext := filepath.Ext(name)
+				name = fmt.Sprintf("%s_%s%s", strings.TrimSuffix(name, ext), t.uploadRandom(8), ext)
+			}
+
+			return name
+		}
+	}
+
+	nameLength := 25
+	if t.UploadNameLength > 0 {
+		nameLength = t.UploadNameLength
+	}
+
+	return fmt.Sprintf("%s%s%s", t.UploadNamePrefix, t.uploadRandom(nameLength), filepath.Ext(originalName))
+}
+
+// generatedFileName makes a name from NameGenerator safe to save: any directories are dropped, and the extension
+// of originalName is added if the name does not already end with it. An empty result means the name is unusable
+func generatedFileName(name, originalName string) string {
+	name = path.Base(strings.ReplaceAll(name, "\\", "/"))
+	if name == "." || name == "/" || name == ".." {
+		return ""
+	}
+
+	if ext := filepath.Ext(originalName); ext != "" && !strings.EqualFold(filepath.Ext(name), ext) {
+		name += ext
+	}
+
+	return name
+}
+
+// createUploadFile creates a new file in uploadDir for an upload, returning the file and its name. Files are
+// created with O_EXCL so an existing file is never overwritten: renamed uploads retry with a fresh random name
+// on a collision, while uploads keeping their original name fail with an error wrapping fs.ErrExist
+func (t *Tools) createUploadFile(uploadDir, originalName, fileType string, renameFile bool) (*os.File, string, error) {
+	for attempt := 1; ; attempt++ {
+		name := t.uploadFileName(originalName, fileType, renameFile, attempt)
+
+		outfile, err := os.OpenFile(filepath.Join(uploadDir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			return outfile, name, nil
+		}
+
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, "", err
+		}
+
+		if !renameFile || attempt == maxNameAttempts {
+			return nil, "", fmt.Errorf("a file named '%s' already exists: %w", name, err)
+		}
+	}
+}
+
+// uploadFile checks that a single file from a multipart form is permitted, and saves it to uploadDir
+func (t *Tools) uploadFile(fileHeader *multipart.FileHeader, uploadDir string, renameFile bool) (*UploadedFile, error) {
+	return t.logUpload(fileHeader, func() (*UploadedFile, error) {
+		return t.saveUploadedFile(fileHeader, uploadDir, renameFile)
+	})
+}
+
+// logUpload logs the start and outcome of save, which uploads the file described by fileHeader
+func (t *Tools) logUpload(fileHeader *multipart.FileHeader, save func() (*UploadedFile, error)) (*UploadedFile, error) {
+	t.logInfo("upload started", "file", fileHeader.Filename, "size", fileHeader.Size)
+
+	uploadedFile, err := save()
+	if err != nil {
+		t.logError("upload failed", "file", fileHeader.Filename, "error", err)
+		return nil, err
+	}
+
+	t.logInfo("upload completed", "file", fileHeader.Filename, "path", uploadedFile.Path, "size", uploadedFile.FileSize)
+
+	return uploadedFile, nil
+}
+
+// saveUploadedFile does the work of uploadFile
+func (t *Tools) saveUploadedFile(fileHeader *multipart.FileHeader, uploadDir string, renameFile bool) (*UploadedFile, error) {
+	err := t.checkFileSize(fileHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	infile, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer infile.Close()
+
+	fileType, err := t.checkFileType(infile, fileHeader.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := t.stripImageMetadata(infile, fileType, fileHeader.Filename)
+	if err != nil {
+		return nil, err
+	}
+	src = t.reportProgress(src, fileHeader)
+
+	return t.writeUploadedFile(src, uploadDir, fileHeader.Filename, fileType, renameFile)
+}
+
+// stripImageMetadata returns the contents of src, re-encoded to drop any metadata when it is a JPEG or PNG image
+// and StripImageMetadata is set. Anything else is returned untouched
+func (t *Tools) stripImageMetadata(src io.Reader, fileType, filename string) (io.Reader, error) {
+	if !t.StripImageMetadata || (fileType != "image/jpeg" && fileType != "image/png") {
+		return src, nil
+	}
+
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, fmt.Errorf("the uploaded image '%s' is corrupt or truncated", filename)
+	}
+
+	var buf bytes.Buffer
+	if fileType == "image/jpeg" {
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, img)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &buf, nil
+}
+
+// progressReader counts the bytes read from r, passing the running total to report after every read
+type progressReader struct {
+	r        io.Reader
+	filename string
+	read     int64
+	total    int64
+	report   func(filename string, bytesWritten, totalBytes int64)
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	if n > 0 {
+		p.read += int64(n)
+		p.report(p.filename, p.read, p.total)
+	}
+
+	return n, err
+}
+
+// reportProgress wraps src, the contents of the upload described by fileHeader as returned by
+// stripImageMetadata, so that reading it reports progress to ProgressFunc, if one is set
+func (t *Tools) reportProgress(src io.Reader, fileHeader *multipart.FileHeader) io.Reader {
+	if t.ProgressFunc == nil {
+		return src
+	}
+
+	// a re-encoded image is no longer the size of the upload, so the length of the re-encoded data is the total
+	total := fileHeader.Size
+	if buf, ok := src.(*bytes.Buffer); ok {
+		total = int64(buf.Len())
+	}
+
+	return &progressReader{r: src, filename: fileHeader.Filename, total: total, report: t.ProgressFunc}
+}
+
+// writeUploadedFile saves the contents of src, an upload of type fileType that has already been checked, to
+// uploadDir, naming it as uploadFileName does, and placing it in a dated subdirectory with DateBasedUploadPath
+func (t *Tools) writeUploadedFile(src io.Reader, uploadDir, originalName, fileType string, renameFile bool) (*UploadedFile, error) {
+	uploadedFile := UploadedFile{OriginalFileName: originalName}
+
+	var subDir string
+	if t.DateBasedUploadPath {
+		subDir = t.uploadTime().Format("2006/01/02")
+		uploadDir = filepath.Join(uploadDir, filepath.FromSlash(subDir))
+
+		err := t.CreateDirIfNotExists(uploadDir)
+		if err != nil {
+			return nil, errors.New("cannot create/utilize upload directory")
+		}
+	}
+
+	outfile, newFileName, err := t.createUploadFile(uploadDir, originalName, fileType, renameFile)
+	if err != nil {
+		return nil, err
+	}
+	uploadedFile.NewFileName = newFileName
+	uploadedFile.Path = path.Join(subDir, newFileName)
+
+	fileSize, err := io.Copy(outfile, src)
+	if err == nil && t.DurableUploads {
+		err = t.syncUpload(outfile, uploadDir)
+	}
+	if closeErr := outfile.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// a partially written file would otherwise look like a complete upload
+		_ = os.Remove(filepath.Join(uploadDir, newFileName))
+		return nil, err
+	}
+
+	uploadedFile.FileSize = fileSize
+
+	return &uploadedFile, nil
+}
+
+// syncUpload flushes outfile, and then the directory entry naming it, to stable storage. Windows cannot sync
+// directories, so there only the file is synced
+func (t *Tools) syncUpload(outfile *os.File, uploadDir string) error {
+	err := t.syncFile(outfile)
+	if err != nil {
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+
+	dir, err := os.Open(uploadDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	return t.syncFile(dir)
+}
+
+// SaveBase64File saves a file sent as a base64 string, e.g. inside a JSON body, to uploadDir, optionally prefixed
+// as a data URI such as "data:image/png;base64,". The same MaxFileSize, AllowedFileTypes, and naming rules as
+// UploadFiles apply. As there is no original file name, the file is named "upload" with an extension for its
+// detected type unless rename is set. The type declared by a data URI must match the detected type
+func (t *Tools) SaveBase64File(data string, uploadDir string, rename bool) (*UploadedFile, error) {
+	err := t.ValidateConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.checkUploadDir(uploadDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var declaredType string
+	if strings.HasPrefix(data, "data:") {
+		declaredType, data, err = splitDataURI(data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data = strings.TrimSpace(data)
+	if t.MaxFileSize > 0 && base64.StdEncoding.DecodedLen(len(data)) > t.MaxFileSize+2 {
+		return nil, errors.New("the uploaded file is too large")
+	}
+
+	decoded, err := decodeBase64(data)
+	if err != nil {
+		return nil, errors.New("the uploaded file is not valid base64")
+	}
+
+	if t.MaxFileSize > 0 && len(decoded) > t.MaxFileSize {
+		return nil, errors.New("the uploaded file is too large")
+	}
+
+	infile := bytes.NewReader(decoded)
+
+	fileType, err := t.checkFileType(infile, "upload")
+	if err != nil {
+		return nil, err
+	}
+
+	if declaredType != "" && !sameMediaType(declaredType, fileType) {
+		return nil, fmt.Errorf("the uploaded file was declared as '%s' but is of type '%s'", declaredType, fileType)
+	}
+
+	src, err := t.stripImageMetadata(infile, fileType, "upload")
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.CreateDirIfNotExists(uploadDir)
+	if err != nil {
+		return nil, errors.New("cannot create/utilize upload directory")
+	}
+
+	return t.writeUploadedFile(src, uploadDir, "upload"+extensionForType(fileType), fileType, rename)
+}
+
+// ParseDataURI decodes a base64 data URI such as "data:image/png;base64,iVBORw0...", e.g. an inline image in
+// rich text, returning the declared MIME type (including any parameters) and the decoded data. As RFC 2397
+// specifies, a URI that declares no type is text/plain;charset=US-ASCII. URIs that are not base64 encoded, or
+// whose data is not valid base64, are rejected
+func (t *Tools) ParseDataURI(s string) (string, []byte, error) {
+	if !strings.HasPrefix(s, "data:") {
+		return "", nil, errors.New("the string is not a data URI")
+	}
+
+	mimeType, payload, err := splitDataURI(s)
+	if err != nil {
+		return "", nil, err
+	}
+
+	if mimeType == "" {
+		mimeType = "text/plain;charset=US-ASCII"
+	}
+
+	data, err := decodeBase64(strings.TrimSpace(payload))
+	if err != nil {
+		return "", nil, errors.New("the data URI does not contain valid base64")
+	}
+
+	return mimeType, data, nil
+}
+
+// splitDataURI splits a base64 data URI into its declared MIME type, which may be empty, and its payload
+func splitDataURI(s string) (string, string, error) {
+	meta, payload, found := strings.Cut(strings.TrimPrefix(s, "data:"), ",")
+	if !found || !strings.HasSuffix(meta, ";base64") {
+		return "", "", errors.New("the data URI is not base64 encoded")
+	}
+
+	return strings.TrimSuffix(meta, ";base64"), payload, nil
+}
+
+// decodeBase64 decodes standard base64, with or without padding
+func decodeBase64(s string) ([]byte, error) {
+	decoded, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		decoded, err = base64.RawStdEncoding.DecodeString(s)
+	}
+
+	return decoded, err
+}
+
+// sameMediaType reports whether the content types a and b name the same media type, ignoring parameters such as
+// charset and differences in case and spacing, so "text/plain;charset=utf-8" matches "text/plain; charset=utf-8"
+func sameMediaType(a, b string) bool {
+	aType, _, err := mime.ParseMediaType(a)
+	if err != nil {
+		return false
+	}
+
+	bType, _, err := mime.ParseMediaType(b)
+	if err != nil {
+		return false
+	}
+
+	return aType == bType
+}
+
+// extensionForType returns a file name extension, including the leading dot, for the content type fileType,
+// or an empty string if none is known
+func extensionForType(fileType string) string {
+	mediaType, _, _ := strings.Cut(fileType, ";")
+
+	switch mediaType {
+	case "image/jpeg":
+		return ".jpg"
+	case "text/plain":
+		return ".txt"
+	}
+
+	extensions, err := mime.ExtensionsByType(mediaType)
+	if err != nil || len(extensions) == 0 {
+		return ""
+	}
+
+	return extensions[0]
+}
+
+// UploadFilesTo uploads every file in the multipart form to a destination chosen by the caller, e.g. cloud
+// storage, instead of the local disk. For each file that passes the same MaxFileSize and AllowedFileTypes checks
+// as UploadFiles, sink is called with the name the file would have been saved as and its detected type, and the
+// file is copied to the returned writer, which is then closed. The Path of each UploadedFile is its name. Files
+// are handled in the same order, and with the same UploadConcurrency, as UploadFiles, so sink must be safe for
+// concurrent use when UploadConcurrency is above 1
+func (t *Tools) UploadFilesTo(r *http.Request, sink func(filename string, fileType string) (io.WriteCloser, error), rename ...bool) ([]*UploadedFile, error) {
+	renameFile := true
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1024 * 1024 * 1024
+	}
+
+	if len(rename) > 0 {
+		renameFile = rename[0]
+	}
+
+	err := t.ValidateConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	err = parseUploadForm(r, t.uploadMemory(), int64(t.MaxTotalUploadSize), "")
+	if err != nil {
+		return nil, err
+	}
+	defer r.MultipartForm.RemoveAll()
+
+	return t.uploadEach(formFileHeaders(r.MultipartForm), func(fileHeader *multipart.FileHeader) (*UploadedFile, error) {
+		return t.logUpload(fileHeader, func() (*UploadedFile, error) {
+			return t.streamUploadedFile(fileHeader, sink, renameFile)
+		})
+	})
+}
+
+// streamUploadedFile checks that a single file from a multipart form is permitted, and copies it to the writer
+// returned by sink
+func (t *Tools) streamUploadedFile(fileHeader *multipart.FileHeader, sink func(filename string, fileType string) (io.WriteCloser, error), renameFile bool) (*UploadedFile, error) {
+	err := t.checkFileSize(fileHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	infile, err := fileHeader.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer infile.Close()
+
+	fileType, err := t.checkFileType(infile, fileHeader.Filename)
+	if err != nil {
+		return nil, err
+	}
+
+	src, err := t.stripImageMetadata(infile, fileType, fileHeader.Filename)
+	if err != nil {
+		return nil, err
+	}
+	src = t.reportProgress(src, fileHeader)
+
+	name := t.uploadFileName(fileHeader.Filename, fileType, renameFile, 1)
+
+	outfile, err := sink(name, fileType)
+	if err != nil {
+		return nil, err
+	}
+
+	fileSize, err := io.Copy(outfile, src)
+	if err != nil {
+		_ = outfile.Close()
+		return nil, err
+	}
+
+	err = outfile.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return &UploadedFile{
+		NewFileName:      name,
+		OriginalFileName: fileHeader.Filename,
+		FileSize:         fileSize,
+		Path:             name,
+	}, nil
+}
+
+// UploadFilesAndFields uploads files exactly like UploadFiles, and also returns the non-file values
+// submitted with the multipart form (e.g. a caption), so handlers don't need to parse the form again.
+// The values are returned whenever the form could be parsed, even alongside ErrNoFiles or an error for
+// one of the files, so a form that holds only fields can still be read
+func (t *Tools) UploadFilesAndFields(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, map[string][]string, error) {
+	files, err := t.UploadFiles(r, uploadDir, rename...)
+
+	var fields map[string][]string
+	if r.MultipartForm != nil {
+		fields = r.MultipartForm.Value
+	}
+
+	return files, fields, err
+}
+
+// CreateDirIfNotExists creates a directory and all necessary parents if they do not exist. New directories
+// are created with the optional perm (before umask), defaulting to 0755. An error is returned if path
+// already exists but is not a directory
+func (t *Tools) CreateDirIfNotExists(path string, perm ...os.FileMode) error {
+	var mode os.FileMode = 0755
+	if len(perm) > 0 {
+		mode = perm[0]
+	}
+
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(path, mode)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("'%s' exists but is not a directory", path)
+	}
+
+	return nil
+}
+
+// Slugify converts string s into a URL safe slug
+func (t *Tools) Slugify(s string) (string, error) {
+	if strings.Trim(s, " ") == "" {
+		return "", errors.New("empty string not permitted")
+	}
+
+	var re = regexp.MustCompile(`[^a-z\d]+`)
+	slug := strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if len(slug) == 0 {
+		return "", errors.New("removing non-characters returns zero length slug")
+	}
+
+	return slug, nil
+}
+
+// SlugifyUniqueFunc converts string s into a URL safe slug, appending a numeric suffix until the
+// supplied exists function reports that the candidate is not already taken (e.g. by a database lookup).
+// Any error returned by exists is passed back to the caller
+func (t *Tools) SlugifyUniqueFunc(s string, exists func(candidate string) (bool, error)) (string, error) {
+	slug, err := t.Slugify(s)
+	if err != nil {
+		return "", err
+	}
+
+	candidate := slug
+	for i := 1; ; i++ {
+		taken, err := exists(candidate)
+		if err != nil {
+			return "", err
+		}
+
+		if !taken {
+			return candidate, nil
+		}
+
+		candidate = fmt.Sprintf("%s-%d", slug, i)
+	}
+}
+
+// DownloadStaticFile sends file to the client and attempts to force the browser to download the file,
+// saving it as the value provided in the displayName parameter. The content type is detected from the file
+// name unless the optional contentType is supplied
+func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string, contentType ...string) {
+	if _, err := os.Stat(pathName); os.IsNotExist(err) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	if len(contentType) > 0 && contentType[0] != "" {
+		w.Header().Set("Content-Type", contentType[0])
+	}
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+
+	http.ServeFile(w, r, pathName)
+}
+
+// DownloadBytes sends data, e.g. a report generated in memory, to the client and attempts to force the browser
+// to download it, saving it as displayName. An empty contentType is sent as application/octet-stream
+func (t *Tools) DownloadBytes(w http.ResponseWriter, data []byte, contentType, displayName string) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+	w.WriteHeader(http.StatusOK)
+
+	_, _ = w.Write(data)
+}
+
+// WriteCSV sends headers and rows to the client as a CSV download saved as filename, quoting any field that
+// contains a comma, quote, or newline. A nil headers writes only the rows
+func (t *Tools) WriteCSV(w http.ResponseWriter, filename string, headers []string, rows [][]string) error {
+	return t.writeCSV(w, filename, headers, func(cw *csv.Writer) error {
+		return cw.WriteAll(rows)
+	})
+}
+
+// WriteCSVStream sends a CSV download exactly like WriteCSV, but writes each row as it is received from rows,
+// so that large exports need not be held in memory. The response is flushed periodically when w supports
+// http.Flusher. If writing fails the error is returned, and the caller should stop sending on rows
+func (t *Tools) WriteCSVStream(w http.ResponseWriter, filename string, headers []string, rows <-chan []string) error {
+	const flushEvery = 100
+
+	flusher, _ := w.(http.Flusher)
+
+	return t.writeCSV(w, filename, headers, func(cw *csv.Writer) error {
+		count := 0
+		for row := range rows {
+			if err := cw.Write(row); err != nil {
+				return err
+			}
+
+			count++
+			if flusher != nil && count%flushEvery == 0 {
+				cw.Flush()
+				if err := cw.Error(); err != nil {
+					return err
+				}
+				flusher.Flush()
+			}
+		}
+
+		return nil
+	})
+}
+
+// writeCSV sets the headers for a CSV download, then writes headers followed by the rows written by writeRows
+func (t *Tools) writeCSV(w http.ResponseWriter, filename string, headers []string, writeRows func(cw *csv.Writer) error) error {
+	if alreadyWritten(w) {
+		return ErrResponseAlreadyWritten
+	}
+
+	t.setResponseHeaders(w)
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+	w.WriteHeader(http.StatusOK)
+
+	cw := csv.NewWriter(w)
+
+	if headers != nil {
+		if err := cw.Write(headers); err != nil {
+			return err
+		}
+	}
+
+	if err := writeRows(cw); err != nil {
+		return err
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// ServeFromDir sends the file requestedName, typically taken from the request, from within baseDir. The name is
+// cleaned and must resolve (following any symlinks) to a file inside baseDir, so a request escaping it, e.g. via
+// "../", receives a 403, while missing files and directories receive a 404; directories are never listed. The
+// file is served inline, or as a download when asAttachment is set, and range requests are supported
+func (t *Tools) ServeFromDir(w http.ResponseWriter, r *http.Request, baseDir, requestedName string, asAttachment bool) {
+	base, err := filepath.Abs(baseDir)
+	if err == nil {
+		base, err = filepath.EvalSymlinks(base)
+	}
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	inside := func(name string) bool {
+		rel, err := filepath.Rel(base, name)
+		return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+	}
+
+	name := filepath.Join(base, filepath.FromSlash(requestedName))
+	if !inside(name) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	if !inside(resolved) {
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	file, err := os.Open(resolved)
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil || info.IsDir() {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	disposition := "inline"
+	if asAttachment {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=\"%s\"", disposition, filepath.Base(name)))
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), file)
+}
+
+// JSONResponse is used to relay JSON payloads
+type JSONResponse struct {
+	Error   bool              `json:"error"`
+	Message string            `json:"message"`
+	Code    string            `json:"code,omitempty"`
+	Data    interface{}       `json:"data,omitempty"`
+	Meta    map[string]string `json:"meta,omitempty"`
+	Errors  map[string]string `json:"errors,omitempty"`
+}
+
+// Errors returned by ReadJSON and DecodeJSON. The returned errors carry a more descriptive message for
+// logging, but can be matched against these with errors.Is
+var (
+	ErrBadlyFormedJSON   = errors.New("body contains badly formed JSON")
+	ErrIncorrectJSONType = errors.New("body contains incorrect JSON type")
+	ErrEmptyBody         = errors.New("body must not be empty")
+	ErrUnknownField      = errors.New("body contains unknown key")
+	ErrBodyTooLarge      = errors.New("body is too large")
+	ErrMultiplePayloads  = errors.New("body must not contain more than one JSON payload")
+	ErrJSONTooDeep       = errors.New("body is nested too deeply")
+)
+
+// UnknownFieldError is returned when a JSON body contains a key that does not correspond to a field
+// of the destination, and unknown fields are not allowed
+type UnknownFieldError struct {
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return fmt.Sprintf("body contains unknown key %q", e.Field)
+}
+
+func (e *UnknownFieldError) Unwrap() error {
+	return ErrUnknownField
+}
+
+// BodyTooLargeError is returned when a request body is larger than the limit it is read with. Size is the length
+// of the body when its Content-Length says so, and zero when that is unknown, since a body is read only one byte
+// past Limit
+type BodyTooLargeError struct {
+	Limit int
+	Size  int64
+}
+
+func (e *BodyTooLargeError) Error() string {
+	if e.Size > 0 {
+		return fmt.Sprintf("body must not be larger than %d bytes, but is %d bytes", e.Limit, e.Size)
+	}
+
+	return fmt.Sprintf("body must not be larger than %d bytes", e.Limit)
+}
+
+func (e *BodyTooLargeError) Unwrap() error {
+	return ErrBodyTooLarge
+}
+
+// jsonDecodeError pairs a descriptive error message with the exported error it should match
+type jsonDecodeError struct {
+	msg string
+	err error
+}
+
+func (e *jsonDecodeError) Error() string {
+	return e.msg
+}
+
+func (e *jsonDecodeError) Unwrap() error {
+	return e.err
+}
+
+// ReadJSON attempts to convert the body of a request from JSON into a go data variable. The body may be
+// any single JSON value, including a top-level array decoded into a slice, but anything following that
+// value is rejected with ErrMultiplePayloads. A leading UTF-8 byte-order mark, as sent by some Windows
+// clients, is ignored
+func (t *Tools) ReadJSON(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	// try to prevent malicious content size
+	maxBytes := 1024 * 1024
+	if t.MaxJSONSize != 0 {
+		maxBytes = t.MaxJSONSize
+	}
+
+	return t.ReadJSONLimited(w, r, data, maxBytes)
+}
+
+// ReadJSONLimited behaves exactly like ReadJSON, but reads no more than maxBytes instead of MaxJSONSize, e.g.
+// for a bulk import endpoint that needs a larger limit than the rest of the service
+func (t *Tools) ReadJSONLimited(w http.ResponseWriter, r *http.Request, data interface{}, maxBytes int) error {
+	if maxBytes <= 0 {
+		maxBytes = 1024 * 1024
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	if t.MaxJSONDepth > 0 {
+		raw, err := io.ReadAll(r.Body)
+		if err != nil {
+			return describeBodySize(describeJSONError(err, maxBytes), r, maxBytes)
+		}
+
+		err = checkJSONDepth(raw, t.MaxJSONDepth)
+		if err != nil {
+			return err
+		}
+
+		return DecodeJSON(bytes.NewReader(raw), data, maxBytes, t.AllowUnknownFields)
+	}
+
+	return describeBodySize(DecodeJSON(r.Body, data, maxBytes, t.AllowUnknownFields), r, maxBytes)
+}
+
+// ReadJSONAllowUnknown reads JSON exactly like ReadJSON, except that unknown fields are ignored for this call
+// whatever AllowUnknownFields is set to, e.g. for endpoints that accept forward-compatible payloads
+func (t *Tools) ReadJSONAllowUnknown(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	lenient := *t
+	lenient.AllowUnknownFields = true
+
+	return lenient.ReadJSON(w, r, data)
+}
+
+// describeBodySize records the size of the body of r, as far as it is known, in a BodyTooLargeError. Other
+// errors are returned unchanged
+func describeBodySize(err error, r *http.Request, maxBytes int) error {
+	var tooLarge *BodyTooLargeError
+	if !errors.As(err, &tooLarge) {
+		return err
+	}
+
+	// the body is only read one byte past the limit, so its full size is known only from Content-Length
+	if r.ContentLength > int64(maxBytes) {
+		tooLarge.Size = r.ContentLength
+	}
+
+	return tooLarge
+}
+
+// checkJSONDepth scans raw and returns an error if its objects and arrays are nested more than maxDepth deep.
+// Malformed JSON is left for the decoder to report
+func checkJSONDepth(raw []byte, maxDepth int) error {
+	dec := json.NewDecoder(bytes.NewReader(bytes.TrimPrefix(raw, utf8BOM)))
+	depth := 0
+
+	for {
+		token, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+
+		switch token {
+		case json.Delim('{'), json.Delim('['):
+			depth++
+			if depth > maxDepth {
+				return &jsonDecodeError{
+					msg: fmt.Sprintf("body must not be nested more than %d levels deep", maxDepth),
+					err: ErrJSONTooDeep,
+				}
+			}
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		}
+	}
+}
+
+// ReadJSONOrError calls ReadJSON and, if it fails, writes the error to the client with ErrorJSONForRequest using
+// the optional status (400 by default). It returns whether decoding succeeded, so a handler can simply return
+// when it is false
+func (t *Tools) ReadJSONOrError(w http.ResponseWriter, r *http.Request, data interface{}, status ...int) bool {
+	err := t.ReadJSON(w, r, data)
+	if err != nil {
+		_ = t.ErrorJSONForRequest(w, r, err, status...)
+		return false
+	}
+
+	return true
+}
+
+// ReadJSONEach decodes a request body holding a JSON array one element at a time, so that huge arrays can be
+// ingested in constant memory. elem must be a pointer; it is reset to its zero value and each element decoded
+// into it before fn is called, so fn must copy anything it keeps. MaxJSONSize and MaxJSONDepth apply to each
+// element on its own, while the body as a whole is limited only by MaxJSONStreamSize. Elements are otherwise
+// decoded with the same rules and descriptive errors as ReadJSON. An error returned by fn stops decoding and is
+// returned unchanged
+func (t *Tools) ReadJSONEach(w http.ResponseWriter, r *http.Request, elem interface{}, fn func() error) error {
+	maxBytes := 1024 * 1024
+	if t.MaxJSONSize != 0 {
+		maxBytes = t.MaxJSONSize
+	}
+
+	target := reflect.ValueOf(elem)
+	if target.Kind() != reflect.Pointer || target.IsNil() {
+		return errors.New("elem must be a non-nil pointer")
+	}
+
+	if t.MaxJSONStreamSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, int64(t.MaxJSONStreamSize))
+	}
+
+	body := &elementLimitReader{r: skipBOM(r.Body), limit: int64(maxBytes)}
+	dec := json.NewDecoder(body)
+
+	describe := func(err error) error {
+		if errors.Is(err, errElementTooLarge) {
+			return &BodyTooLargeError{Limit: maxBytes}
+		}
+
+		return describeBodySize(describeJSONError(err, t.MaxJSONStreamSize), r, t.MaxJSONStreamSize)
+	}
+
+	token, err := dec.Token()
+	if err != nil {
+		return describe(err)
+	}
+
+	if token != json.Delim('[') {
+		return &jsonDecodeError{msg: "body must be a JSON array", err: ErrIncorrectJSONType}
+	}
+
+	// the decoder reads ahead of the element it is decoding, so the reader is allowed well past the element
+	// limit, which is then checked exactly against each decoded element
+	window := 2*int64(maxBytes) + 4096
+
+	for dec.More() {
+		body.limit = dec.InputOffset() + window
+
+		var raw json.RawMessage
+		err = dec.Decode(&raw)
+		if err != nil {
+			return describe(err)
+		}
+
+		if len(raw) > maxBytes {
+			return &BodyTooLargeError{Limit: maxBytes, Size: int64(len(raw))}
+		}
+
+		if t.MaxJSONDepth > 0 {
+			err = checkJSONDepth(raw, t.MaxJSONDepth)
+			if err != nil {
+				return err
+			}
+		}
+
+		target.Elem().Set(reflect.Zero(target.Elem().Type()))
+
+		elemDec := json.NewDecoder(bytes.NewReader(raw))
+		if !t.AllowUnknownFields {
+			elemDec.DisallowUnknownFields()
+		}
+
+		err = elemDec.Decode(elem)
+		if err != nil {
+			return describe(err)
+		}
+
+		err = fn()
+		if err != nil {
+			return err
+		}
+	}
+
+	// consume the closing bracket, then make sure nothing follows the array
+	body.limit = dec.InputOffset() + window
+
+	_, err = dec.Token()
+	if err != nil {
+		return describe(err)
+	}
+
+	var extra json.RawMessage
+	err = dec.Decode(&extra)
+	if err != io.EOF {
+		return ErrMultiplePayloads
+	}
+
+	return nil
+}
+
+// errElementTooLarge is returned by elementLimitReader when an array element runs past its limit
+var errElementTooLarge = errors.New("array element is too large")
+
+// elementLimitReader stops reading at limit, an offset into the stream that ReadJSONEach moves forward as each
+// array element starts, so that json.Decoder never buffers much more than one element's worth of the body
+type elementLimitReader struct {
+	r     io.Reader
+	read  int64
+	limit int64
+}
+
+func (l *elementLimitReader) Read(p []byte) (int, error) {
+	if l.read >= l.limit {
+		return 0, errElementTooLarge
+	}
+
+	if int64(len(p)) > l.limit-l.read {
+		p = p[:l.limit-l.read]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+
+	return n, err
+}
+
+// ReadJSONWithRaw reads the body of a request once, decodes it from JSON into data exactly as ReadJSON would,
+// and returns the raw bytes of the body, e.g. so that a webhook signature can be verified against them. The raw
+// bytes are returned even if decoding fails, as long as the body could be read within MaxJSONSize
+func (t *Tools) ReadJSONWithRaw(w http.ResponseWriter, r *http.Request, data interface{}) ([]byte, error) {
+	maxBytes := 1024 * 1024
+	if t.MaxJSONSize != 0 {
+		maxBytes = t.MaxJSONSize
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	raw, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, describeBodySize(describeJSONError(err, maxBytes), r, maxBytes)
+	}
+
+	if t.MaxJSONDepth > 0 {
+		err = checkJSONDepth(raw, t.MaxJSONDepth)
+		if err != nil {
+			return raw, err
+		}
+	}
+
+	return raw, DecodeJSON(bytes.NewReader(raw), data, maxBytes, t.AllowUnknownFields)
+}
+
+// ReadString reads the entire body of a request as a string, without interpreting it, reading no more than
+// MaxBodySize bytes. This suits webhooks that send non-JSON payloads or need the exact raw body
+func (t *Tools) ReadString(w http.ResponseWriter, r *http.Request) (string, error) {
+	maxBytes := 1024 * 1024
+	if t.MaxBodySize != 0 {
+		maxBytes = t.MaxBodySize
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return "", &BodyTooLargeError{Limit: maxBytes}
+		}
+
+		return "", err
+	}
+
+	return string(body), nil
+}
+
+// ErrInvalidFormValue is matched by the error returned by ReadForm when a value can't be converted to the type
+// of its field
+var ErrInvalidFormValue = errors.New("form contains a value of the wrong type")
+
+// ReadForm parses an application/x-www-form-urlencoded or multipart/form-data request body and stores its values
+// in the struct pointed to by data, reading no more than MaxBodySize bytes. Files in a multipart body are not
+// stored, but remain available in r.MultipartForm. Values are matched to fields by their
+// `form:"name"` tag, or their go name when untagged, and a tag of "-" skips a field. String, bool, integer,
+// and float fields are supported, along with slices of them for repeated values. Values without a field are
+// rejected with an *UnknownFieldError unless AllowUnknownFields is set
+func (t *Tools) ReadForm(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	maxBytes := 1024 * 1024
+	if t.MaxBodySize != 0 {
+		maxBytes = t.MaxBodySize
+	}
+
+	v := reflect.ValueOf(data)
+	if v.Kind() != reflect.Pointer || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("ReadForm requires a non-nil pointer to a struct")
+	}
+	v = v.Elem()
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	// the whole body fits within maxBytes, so a multipart form is held in memory rather than spilling to disk
+	var err error
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "multipart/form-data" {
+		err = r.ParseMultipartForm(int64(maxBytes))
+	} else {
+		err = r.ParseForm()
+	}
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			return &BodyTooLargeError{Limit: maxBytes}
+		}
+
+		return err
+	}
+
+	fields := make(map[string]reflect.Value)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Name
+		if tag, _, _ := strings.Cut(field.Tag.Get("form"), ","); tag == "-" {
+			continue
+		} else if tag != "" {
+			name = tag
+		}
+
+		fields[name] = v.Field(i)
+	}
+
+	for key, values := range r.PostForm {
+		field, ok := fields[key]
+		if !ok {
+			if t.AllowUnknownFields {
+				continue
+			}
+			return &UnknownFieldError{Field: key}
+		}
+
+		if field.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(field.Type(), len(values), len(values))
+			for i, value := range values {
+				if err := setFormValue(slice.Index(i), value); err != nil {
+					return formValueError(key, slice.Index(i))
+				}
+			}
+			field.Set(slice)
+			continue
+		}
+
+		if err := setFormValue(field, values[0]); err != nil {
+			return formValueError(key, field)
+		}
+	}
+
+	return nil
+}
+
+// setFormValue converts value to the type of field and stores it there
+func setFormValue(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetInt(n)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetUint(n)
+
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, field.Type().Bits())
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+
+	default:
+		return fmt.Errorf("unsupported field type %s", field.Type())
+	}
+
+	return nil
+}
+
+// formValueError describes a form value that could not be stored in field
+func formValueError(key string, field reflect.Value) error {
+	return &jsonDecodeError{
+		msg: fmt.Sprintf("form contains incorrect type for field %q, expected %s", key, field.Kind()),
+		err: ErrInvalidFormValue,
+	}
+}
+
+// ReadJSONInto is a generic convenience wrapper around ReadJSON that allocates a value of type T, decodes
+// the body of the request into it, and returns it. Errors are identical to those returned by ReadJSON
+func ReadJSONInto[T any](w http.ResponseWriter, r *http.Request, t *Tools) (T, error) {
+	var data T
+	err := t.ReadJSON(w, r, &data)
+
+	return data, err
+}
+
+// JSONHandler wraps fn in an http.HandlerFunc that decodes the request body into a Req using ReadJSON,
+// calls fn with the request context, and writes the returned Res as JSON with the returned status. Decode
+// errors are sent with ErrorJSON as a 400, and errors returned by fn are sent with ErrorJSON using the
+// returned status, or 500 if none was given
+func JSONHandler[Req, Res any](fn func(ctx context.Context, req Req) (Res, int, error), t *Tools) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		req, err := ReadJSONInto[Req](w, r, t)
+		if err != nil {
+			_ = t.ErrorJSONForRequest(w, r, err)
+			return
+		}
+
+		res, status, err := fn(r.Context(), req)
+		if err != nil {
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			_ = t.ErrorJSONForRequest(w, r, err, status)
+			return
+		}
+
+		if status == 0 {
+			status = http.StatusOK
+		}
+		_ = t.WriteJSON(w, status, res)
+	}
+}
+
+// DecodeJSON attempts to convert JSON read from r into a go data variable, reading no more than
+// maxBytes. It returns the same descriptive errors as ReadJSON, which makes it suitable for decoding
+// JSON outside an HTTP handler, e.g. from a queue message or a file. A maxBytes of zero or less
+// uses the same 1MB default as ReadJSON
+func DecodeJSON(r io.Reader, data interface{}, maxBytes int, allowUnknown bool) error {
+	if maxBytes <= 0 {
+		maxBytes = 1024 * 1024
+	}
+
+	dec := json.NewDecoder(&limitedReader{r: skipBOM(r), limit: int64(maxBytes)})
+	if !allowUnknown {
+		dec.DisallowUnknownFields()
+	}
+
+	err := dec.Decode(data)
+	if err != nil {
+		return describeJSONError(err, maxBytes)
+	}
+
+	// decode any trailing value as raw JSON, so that its shape (or the unknown field rules) can't affect
+	// whether it is reported as a second payload
+	var extra json.RawMessage
+	err = dec.Decode(&extra)
+	if err != io.EOF {
+		return ErrMultiplePayloads
+	}
+
+	return nil
+}
+
+// ValidateJSON checks that the body of a request is a single well-formed JSON value without decoding it into
+// a go data variable, returning the kind of the top-level value ("object", "array", or "scalar") and the size of
+// the body in bytes. The body is limited to MaxJSONSize, and errors match those returned by ReadJSON
+func (t *Tools) ValidateJSON(r *http.Request) (string, int, error) {
+	maxBytes := 1024 * 1024
+	if t.MaxJSONSize != 0 {
+		maxBytes = t.MaxJSONSize
+	}
+
+	body := &limitedReader{r: r.Body, limit: int64(maxBytes)}
+	dec := json.NewDecoder(body)
+
+	kind, depth := "", 0
+
+	for {
+		token, err := dec.Token()
+		if err == io.EOF && kind != "" && depth == 0 {
+			break
+		}
+
+		if err == io.EOF && kind != "" {
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err != nil {
+			return "", int(body.read), describeJSONError(err, maxBytes)
+		}
+
+		if kind != "" && depth == 0 {
+			return "", int(body.read), ErrMultiplePayloads
+		}
+
+		switch token {
+		case json.Delim('{'):
+			if kind == "" {
+				kind = "object"
+			}
+			depth++
+		case json.Delim('['):
+			if kind == "" {
+				kind = "array"
+			}
+			depth++
+		case json.Delim('}'), json.Delim(']'):
+			depth--
+		default:
+			if kind == "" {
+				kind = "scalar"
+			}
+		}
+	}
+
+	return kind, int(body.read), nil
+}
+
+// ErrMissingField is matched by the errors returned by ValidateRequired when a required field is missing
+var ErrMissingField = errors.New("required field is missing")
+
+// MissingFieldError is returned by ValidateRequired when a required field holds its zero value
+type MissingFieldError struct {
+	Field string
+}
+
+func (e *MissingFieldError) Error() string {
+	return fmt.Sprintf("field %q is required", e.Field)
+}
+
+func (e *MissingFieldError) Unwrap() error {
+	return ErrMissingField
+}
+
+// ValidateRequired checks that each of the named fields of the struct data (or a pointer to one), typically
+// after ReadJSON, does not hold its zero value, returning a *MissingFieldError naming the first one that does.
+// Fields are named by their go name or JSON key, and nested fields by a dotted path such as "Address.City";
+// a nil pointer along the path counts as missing. This is a post-decode guard, not schema validation
+func (t *Tools) ValidateRequired(data interface{}, fields ...string) error {
+	for _, field := range fields {
+		v := reflect.ValueOf(data)
+
+		for _, name := range strings.Split(field, ".") {
+			for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+				if v.IsNil() {
+					return &MissingFieldError{Field: field}
+				}
+				v = v.Elem()
+			}
+
+			if v.Kind() != reflect.Struct {
+				return fmt.Errorf("cannot validate field %q of non-struct type %s", field, v.Kind())
+			}
+
+			fv, ok := structFieldByName(v, name)
+			if !ok {
+				return fmt.Errorf("type %s has no field %q", v.Type(), name)
+			}
+			v = fv
+		}
+
+		if v.IsZero() {
+			return &MissingFieldError{Field: field}
+		}
+	}
+
+	return nil
+}
+
+// structFieldByName returns the field of the struct v with the given go name or JSON key
+func structFieldByName(v reflect.Value, name string) (reflect.Value, bool) {
+	if fv := v.FieldByName(name); fv.IsValid() {
+		return fv, true
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		tag, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if tag == name {
+			return v.Field(i), true
+		}
+	}
+
+	return reflect.Value{}, false
+}
+
+// describeJSONError maps an error from decoding JSON to one of the descriptive errors returned by DecodeJSON
+func describeJSONError(err error, maxBytes int) error {
+	var syntaxError *json.SyntaxError
+	var unmarshalTypeError *json.UnmarshalTypeError
+	var invalidUnmarshalError *json.InvalidUnmarshalError
+	unknownFieldErr := "json: unknown field"
+
+	switch {
+	case errors.As(err, &syntaxError):
+		return &jsonDecodeError{
+			msg: fmt.Sprintf("body contains badly formed JSON at character %d", syntaxError.Offset),
+			err: ErrBadlyFormedJSON,
+		}
+
+	case errors.As(err, &unmarshalTypeError):
+		if unmarshalTypeError.Field != "" {
+			return &jsonDecodeError{
+				msg: fmt.Sprintf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field),
+				err: ErrIncorrectJSONType,
+			}
+		}
+		return &jsonDecodeError{
+			msg: fmt.Sprintf("body contains incorrect JSON at character %d", unmarshalTypeError.Offset),
+			err: ErrIncorrectJSONType,
+		}
+
+	case errors.As(err, &invalidUnmarshalError):
+		return fmt.Errorf("error unmarshalling JSON: %w", err)
+
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return &jsonDecodeError{
+			msg: "body contains badly formed JSON (unexpected EOF)",
+			err: ErrBadlyFormedJSON,
+		}
+
+	case errors.Is(err, io.EOF):
+		return ErrEmptyBody
+
+	case strings.HasPrefix(err.Error(), unknownFieldErr):
+		fieldname := strings.TrimSpace(strings.TrimPrefix(err.Error(), unknownFieldErr))
+		return &UnknownFieldError{Field: strings.Trim(fieldname, `"`)}
+
+	case err.Error() == "http: request body too large":
+		return &BodyTooLargeError{Limit: maxBytes}
+
+	default:
+		return err
+	}
+}
+
+// utf8BOM is the byte-order mark some clients, notably on Windows, put at the start of UTF-8 text
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// skipBOM returns a reader for the contents of r without its leading UTF-8 byte-order mark, if it has one
+func skipBOM(r io.Reader) io.Reader {
+	br := bufio.NewReader(r)
+	if prefix, err := br.Peek(len(utf8BOM)); err == nil && bytes.Equal(prefix, utf8BOM) {
+		br.Discard(len(utf8BOM))
+	}
+
+	return br
+}
+
+// limitedReader reads from r, returning an *http.MaxBytesError once more than limit bytes have been
+// read, so that readers outside an HTTP request fail the same way http.MaxBytesReader does
+type limitedReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.read > l.limit {
+		return 0, &http.MaxBytesError{Limit: l.limit}
+	}
+
+	// read one byte past the limit so we can tell if the source holds more data
+	if remaining := l.limit - l.read; int64(len(p)) > remaining+1 {
+		p = p[:remaining+1]
+	}
+
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	if l.read > l.limit {
+		return n - int(l.read-l.limit), &http.MaxBytesError{Limit: l.limit}
+	}
+
+	return n, err
+}
+
+// WriteJSON takes a response status and arbitrary data and writes JSON to the client. A status of zero is sent
+// as 200, and a status outside the 1xx-5xx range is rejected with an error before anything is written, as is
+// data whose MarshalJSON method panics
+func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
+	start := time.Now()
+
+	out, err := marshalJSON(data)
+	if err != nil {
+		return err
+	}
+
+	status, err = responseStatus(status)
+	if err != nil {
+		return err
+	}
+
+	if alreadyWritten(w) {
+		return ErrResponseAlreadyWritten
+	}
+
+	t.setResponseHeaders(w, headers...)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	n, err := w.Write(out)
+	if t.Metrics != nil {
+		t.Metrics.ObserveResponse(status, n, time.Since(start))
+	}
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// marshalJSON encodes data like json.Marshal, but returns an error instead of panicking when a MarshalJSON
+// method panics, so a bad payload fails only its own response
+func marshalJSON(data interface{}) (out []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			out, err = nil, fmt.Errorf("json: panic while marshalling %T: %v", data, r)
+		}
+	}()
+
+	return json.Marshal(data)
+}
+
+// responseStatus returns the status to send for status, which defaults to 200 when zero, or an error if it
+// is not a valid HTTP status code
+func responseStatus(status int) (int, error) {
+	if status == 0 {
+		return http.StatusOK, nil
+	}
+
+	if status < 100 || status > 599 {
+		return 0, fmt.Errorf("invalid response status %d", status)
+	}
+
+	return status, nil
+}
+
+// ErrResponseAlreadyWritten is returned by WriteJSON and the other response helpers when the response has
+// already been started, which can only be detected for writers wrapped by WriteGuardMiddleware
+var ErrResponseAlreadyWritten = errors.New("response has already been written")
+
+// writeGuard records whether a response has been started, so the response helpers can refuse to write
+// a second, corrupting, response
+type writeGuard struct {
+	http.ResponseWriter
+	written bool
+}
+
+func (g *writeGuard) WriteHeader(status int) {
+	g.written = true
+	g.ResponseWriter.WriteHeader(status)
+}
+
+func (g *writeGuard) Write(p []byte) (int, error) {
+	g.written = true
+	return g.ResponseWriter.Write(p)
+}
+
+func (g *writeGuard) Flush() {
+	if flusher, ok := g.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, e.g. for a WebSocket upgrade, after which nothing more may
+// be written through the response helpers
+func (g *writeGuard) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := g.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking: %w", http.ErrNotSupported)
+	}
+
+	g.written = true
+
+	return hijacker.Hijack()
+}
+
+func (g *writeGuard) Unwrap() http.ResponseWriter {
+	return g.ResponseWriter
+}
+
+// WriteGuardMiddleware returns middleware that tracks whether each response has been started, so that calling
+// WriteJSON or another response helper after a status or body has already been written returns
+// ErrResponseAlreadyWritten instead of silently corrupting the response
+func (t *Tools) WriteGuardMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&writeGuard{ResponseWriter: w}, r)
+	})
+}
+
+// alreadyWritten reports whether w is known to have started its response
+func alreadyWritten(w http.ResponseWriter) bool {
+	guard, ok := w.(*writeGuard)
+	return ok && guard.written
+}
+
+// setResponseHeaders applies DefaultResponseHeaders followed by the optional per-call headers, which replace
+// any default with the same key. Defaults never replace a header that is already set on w, e.g. by middleware,
+// and Vary values are always merged with the ones already present, since each names something the body
+// depends on. Values are copied, so the response never shares them with Tools or the caller
+func (t *Tools) setResponseHeaders(w http.ResponseWriter, headers ...http.Header) {
+	h := w.Header()
+	preset := make(map[string]bool, len(h))
+	for key, value := range h {
+		preset[key] = len(value) > 0
+	}
+
+	for key, value := range t.DefaultResponseHeaders {
+		key = http.CanonicalHeaderKey(key)
+		if key == "Vary" {
+			addVary(h, value...)
+			continue
+		}
+
+		if !preset[key] {
+			h[key] = append([]string(nil), value...)
+		}
+	}
+
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			key = http.CanonicalHeaderKey(key)
+			if key == "Vary" {
+				addVary(h, value...)
+				continue
+			}
+
+			h[key] = append([]string(nil), value...)
+		}
+	}
+}
+
+// addVary adds each of the comma separated field names in values to the Vary header of h, skipping any that
+// are already listed
+func addVary(h http.Header, values ...string) {
+	existing := make(map[string]bool)
+	for _, value := range h.Values("Vary") {
+		for _, name := range strings.Split(value, ",") {
+			existing[strings.ToLower(strings.TrimSpace(name))] = true
+		}
+	}
+
+	for _, value := range values {
+		for _, name := range strings.Split(value, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" || existing[strings.ToLower(name)] {
+				continue
+			}
+
+			existing[strings.ToLower(name)] = true
+			h.Add("Vary", name)
+		}
+	}
+}
+
+// WriteXML takes a response status and arbitrary data and writes XML to the client
+func (t *Tools) WriteXML(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
+	out, err := xml.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	status, err = responseStatus(status)
+	if err != nil {
+		return err
+	}
+
+	if alreadyWritten(w) {
+		return ErrResponseAlreadyWritten
+	}
+
+	t.setResponseHeaders(w, headers...)
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+
+	_, err = w.Write([]byte(xml.Header))
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(out)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WriteCreated writes data as JSON with a 201 Created status and a Location header pointing to the new
+// resource, as REST conventions expect after a successful create
+func (t *Tools) WriteCreated(w http.ResponseWriter, location string, data interface{}) error {
+	return t.WriteJSON(w, http.StatusCreated, data, http.Header{"Location": {location}})
+}
+
+// WriteText takes a response status and a string and writes it to the client as plain text
+func (t *Tools) WriteText(w http.ResponseWriter, status int, s string, headers ...http.Header) error {
+	return t.writeBody(w, status, "text/plain; charset=utf-8", []byte(s), headers...)
+}
+
+// WriteHTML takes a response status and a string of HTML and writes it to the client
+func (t *Tools) WriteHTML(w http.ResponseWriter, status int, html string, headers ...http.Header) error {
+	return t.writeBody(w, status, "text/html; charset=utf-8", []byte(html), headers...)
+}
+
+// writeBody writes body to the client with the given status and content type, after any optional headers
+func (t *Tools) writeBody(w http.ResponseWriter, status int, contentType string, body []byte, headers ...http.Header) error {
+	status, err := responseStatus(status)
+	if err != nil {
+		return err
+	}
+
+	if alreadyWritten(w) {
+		return ErrResponseAlreadyWritten
+	}
+
+	t.setResponseHeaders(w, headers...)
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+
+	_, err = w.Write(body)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WriteNegotiated writes data as either XML or JSON, depending on which the client's Accept header
+// prefers. JSON is used when the header is missing, accepts anything, or names neither format
+func (t *Tools) WriteNegotiated(w http.ResponseWriter, r *http.Request, status int, data interface{}, headers ...http.Header) error {
+	if prefersXML(r.Header.Get("Accept")) {
+		return t.WriteXML(w, status, data, headers...)
+	}
+
+	return t.WriteJSON(w, status, data, headers...)
+}
+
+// prefersXML reports whether an Accept header ranks an XML media type above JSON
+func prefersXML(accept string) bool {
+	jsonQuality, xmlQuality := -1.0, -1.0
+
+	for _, entry := range strings.Split(accept, ",") {
+		params := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		switch mediaType {
+		case "application/json", "*/*", "application/*":
+			if quality > jsonQuality {
+				jsonQuality = quality
+			}
+		case "application/xml", "text/xml":
+			if quality > xmlQuality {
+				xmlQuality = quality
+			}
+		}
+	}
+
+	return xmlQuality > 0 && xmlQuality > jsonQuality
+}
+
+// WantsJSON reports whether the client making r expects a JSON response, e.g. so shared error handling can
+// answer API clients with JSON and browsers with HTML. That is the case when the Accept header names
+// application/json or a +json type (unless with q=0), the path ends in .json, or X-Requested-With is
+// XMLHttpRequest. A wildcard Accept header alone does not count
+func (t *Tools) WantsJSON(r *http.Request) bool {
+	if strings.HasSuffix(strings.ToLower(r.URL.Path), ".json") {
+		return true
+	}
+
+	if strings.EqualFold(r.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return true
+	}
+
+	for _, entry := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(entry, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(params[0]))
+
+		if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+			continue
+		}
+
+		rejected := false
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil && q == 0 {
+					rejected = true
+				}
+			}
+		}
+
+		if !rejected {
+			return true
+		}
+	}
+
+	return false
+}
+
+// jsonpCallbackPattern matches the JavaScript identifiers, optionally dotted, accepted as JSONP callbacks
+var jsonpCallbackPattern = regexp.MustCompile(`^[a-zA-Z_$][a-zA-Z0-9_$]*(\.[a-zA-Z_$][a-zA-Z0-9_$]*)*$`)
+
+// WriteJSONP writes data as JSON wrapped in a call to the JavaScript function named by the callbackParam query
+// parameter of r, for legacy clients that load JSON with a script tag. The callback must be a plain (optionally
+// dotted) identifier of at most 128 characters, otherwise an error is returned and nothing is written, which
+// prevents script injection. Without the query parameter, data is written as plain JSON with WriteJSON
+func (t *Tools) WriteJSONP(w http.ResponseWriter, r *http.Request, status int, data interface{}, callbackParam string, headers ...http.Header) error {
+	callback := r.URL.Query().Get(callbackParam)
+	if callback == "" {
+		return t.WriteJSON(w, status, data, headers...)
+	}
+
+	if len(callback) > 128 || !jsonpCallbackPattern.MatchString(callback) {
+		return fmt.Errorf("invalid JSONP callback name '%s'", callback)
+	}
+
+	out, err := marshalJSON(data)
+	if err != nil {
+		return err
+	}
+
+	// the leading comment stops the response being interpreted as anything but JavaScript
+	body := fmt.Sprintf("/**/%s(%s);", callback, out)
+
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	return t.writeBody(w, status, "application/javascript", []byte(body), headers...)
+}
+
+// WriteJSONCompressed writes data as JSON exactly like WriteJSON, except that the body is gzip compressed when
+// the client's Accept-Encoding header allows it and the JSON is at least GzipMinSize bytes, using GzipLevel
+func (t *Tools) WriteJSONCompressed(w http.ResponseWriter, r *http.Request, status int, data interface{}, headers ...http.Header) error {
+	out, err := marshalJSON(data)
+	if err != nil {
+		return err
+	}
+
+	minSize := 1024
+	if t.GzipMinSize > 0 {
+		minSize = t.GzipMinSize
+	}
+
+	// Vary travels with the per-call headers so that it is merged with, rather than replaced by, any Vary set
+	// by middleware or DefaultResponseHeaders
+	callHeaders := make(http.Header)
+	if len(headers) > 0 {
+		for key, value := range headers[0] {
+			callHeaders[http.CanonicalHeaderKey(key)] = append([]string(nil), value...)
+		}
+	}
+	addVary(callHeaders, "Accept-Encoding")
+	headers = []http.Header{callHeaders}
+
+	if len(out) < minSize || !acceptsGzip(r.Header.Get("Accept-Encoding")) {
+		return t.writeBody(w, status, "application/json", out, headers...)
+	}
+
+	level := t.GzipLevel
+	if level == gzip.NoCompression || level < gzip.HuffmanOnly || level > gzip.BestCompression {
+		level = gzip.DefaultCompression
+	}
+
+	var buf bytes.Buffer
+	gz, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		return err
+	}
+
+	_, err = gz.Write(out)
+	if err != nil {
+		return err
+	}
+
+	err = gz.Close()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Encoding", "gzip")
+
+	return t.writeBody(w, status, "application/json", buf.Bytes(), headers...)
+}
+
+// acceptsGzip reports whether an Accept-Encoding header permits a gzip encoded response
+func acceptsGzip(acceptEncoding string) bool {
+	for _, entry := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(entry, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		quality := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if quality > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// WriteJSONStream writes every value received from ch to the client as the elements of a JSON array, encoding
+// each one as it arrives so that memory use stays flat for large exports. The response is flushed periodically
+// when w supports http.Flusher. If a value cannot be marshalled the stream is abandoned and the error returned;
+// as the status has already been sent, the client receives a truncated array, and the caller should stop
+// sending on ch
+func (t *Tools) WriteJSONStream(w http.ResponseWriter, status int, ch <-chan interface{}, headers ...http.Header) error {
+	const flushEvery = 100
+
+	status, err := responseStatus(status)
+	if err != nil {
+		return err
+	}
+
+	if alreadyWritten(w) {
+		return ErrResponseAlreadyWritten
+	}
+
+	t.setResponseHeaders(w, headers...)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	flusher, _ := w.(http.Flusher)
+
+	if _, err := w.Write([]byte("[")); err != nil {
+		return err
+	}
+
+	count := 0
+	for value := range ch {
+		out, err := marshalJSON(value)
+		if err != nil {
+			return err
+		}
+
+		if count > 0 {
+			if _, err = w.Write([]byte(",")); err != nil {
+				return err
+			}
+		}
+
+		if _, err = w.Write(out); err != nil {
+			return err
+		}
+
+		count++
+		if flusher != nil && count%flushEvery == 0 {
+			flusher.Flush()
+		}
+	}
+
+	if _, err := w.Write([]byte("]")); err != nil {
+		return err
+	}
+
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	return nil
+}
+
+// Envelope is used to write ad-hoc JSON objects without defining a struct, e.g. Envelope{"token": token}
+type Envelope map[string]interface{}
+
+// WriteData writes a JSON object to the client containing the single key and value supplied
+func (t *Tools) WriteData(w http.ResponseWriter, status int, key string, value interface{}, headers ...http.Header) error {
+	return t.WriteJSON(w, status, Envelope{key: value}, headers...)
+}
+
+// PartialJSONResponse is used to relay results that may have been cut short by a deadline
+type PartialJSONResponse struct {
+	Partial bool          `json:"partial"`
+	Data    []interface{} `json:"data"`
+}
+
+// WriteJSONBeforeDeadline collects values from results until the channel is closed or the deadline
+// is reached, whichever comes first, and writes them to the client as a PartialJSONResponse. If the
+// deadline is reached before the producer closes the channel, whatever has been collected so far is
+// written with Partial set to true. Results that arrive after the deadline are read and discarded in the
+// background so that the producer never blocks on results, even if it is unbuffered, but the producer
+// must still close results when it is done, or the background reader is never released
+func (t *Tools) WriteJSONBeforeDeadline(w http.ResponseWriter, status int, deadline time.Time, results <-chan interface{}, headers ...http.Header) error {
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+
+	payload := PartialJSONResponse{Data: make([]interface{}, 0)}
+
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				return t.WriteJSON(w, status, payload, headers...)
+			}
+			payload.Data = append(payload.Data, result)
+
+		case <-timer.C:
+			go func() {
+				for range results {
+				}
+			}()
+
+			payload.Partial = true
+			return t.WriteJSON(w, status, payload, headers...)
+		}
+	}
+}
+
+// ManifestPart describes one piece of a download that has been split across several files
+type ManifestPart struct {
+	URL      string `json:"url"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum"`
+}
+
+// Manifest lists the parts of a split download so that clients can fetch and verify each piece
+type Manifest struct {
+	Parts     []ManifestPart `json:"parts"`
+	TotalSize int64          `json:"total_size"`
+}
+
+// WriteManifestJSON writes a Manifest for the supplied parts to the client with a 200 status. The URL of each
+// part is signed with SignPayload using secret, in a "signature" query parameter, so the server handing out
+// the parts can check them with VerifyManifestURL
+func (t *Tools) WriteManifestJSON(w http.ResponseWriter, parts []ManifestPart, secret string, headers ...http.Header) error {
+	manifest := Manifest{Parts: make([]ManifestPart, 0, len(parts))}
+
+	for _, part := range parts {
+		signed, err := t.signManifestURL(secret, part.URL)
+		if err != nil {
+			return err
+		}
+
+		part.URL = signed
+		manifest.Parts = append(manifest.Parts, part)
+		manifest.TotalSize += part.Size
+	}
+
+	return t.WriteJSON(w, http.StatusOK, manifest, headers...)
+}
+
+// signManifestURL adds the signature of rawURL, made with SignPayload, to its query
+func (t *Tools) signManifestURL(secret, rawURL string) (string, error) {
+	u, _, err := unsignedManifestURL(rawURL)
+	if err != nil {
+		return "", err
+	}
+
+	query := u.Query()
+	query.Set("signature", t.SignPayload(secret, []byte(u.String())))
+	u.RawQuery = query.Encode()
+
+	return u.String(), nil
+}
+
+// VerifyManifestURL reports whether rawURL carries a valid signature from WriteManifestJSON for secret
+func (t *Tools) VerifyManifestURL(secret, rawURL string) bool {
+	u, signature, err := unsignedManifestURL(rawURL)
+	if err != nil || signature == "" {
+		return false
+	}
+
+	return t.VerifySignature(secret, []byte(u.String()), signature)
+}
+
+// unsignedManifestURL parses rawURL and splits any signature off its query. The rest of the query is re-encoded
+// in sorted order, so the signed form does not depend on the order of the parameters
+func unsignedManifestURL(rawURL string) (*url.URL, string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, "", err
+	}
+
+	query := u.Query()
+	signature := query.Get("signature")
+	query.Del("signature")
+	u.RawQuery = query.Encode()
+
+	return u, signature, nil
+}
+
+// WriteSuccess wraps data in a JSONResponse with Error set to false and the supplied message, and writes it
+// to the client, giving successful responses the same shape as those from ErrorJSON
+func (t *Tools) WriteSuccess(w http.ResponseWriter, status int, message string, data interface{}, headers ...http.Header) error {
+	var payload JSONResponse
+	payload.Error = false
+	payload.Message = message
+	payload.Data = data
+
+	return t.WriteJSON(w, status, payload, headers...)
+}
+
+// ErrorJSON takes an error and optionally a status code, and sends a formatted JSON error
+func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
+	statusCode := http.StatusBadRequest
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	var payload JSONResponse
+	payload.Error = true
+	payload.Message = err.Error()
+
+	return t.WriteJSON(w, statusCode, payload)
+}
+
+// ErrorJSONForRequest behaves like ErrorJSON, but also includes the fields returned by ErrorContextFunc for
+// the request r in the meta field of the response
+func (t *Tools) ErrorJSONForRequest(w http.ResponseWriter, r *http.Request, err error, status ...int) error {
+	statusCode := http.StatusBadRequest
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	var payload JSONResponse
+	payload.Error = true
+	payload.Message = err.Error()
+
+	if t.ErrorContextFunc != nil {
+		payload.Meta = t.ErrorContextFunc(r)
+	}
+
+	return t.WriteJSON(w, statusCode, payload)
+}
+
+// ErrorJSONWithCode behaves like ErrorJSON, but also includes a machine-readable error code
+// (e.g. "VALIDATION_FAILED") that clients can branch on without parsing the message
+func (t *Tools) ErrorJSONWithCode(w http.ResponseWriter, err error, code string, status ...int) error {
+	statusCode := http.StatusBadRequest
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	var payload JSONResponse
+	payload.Error = true
+	payload.Message = err.Error()
+	payload.Code = code
+
+	return t.WriteJSON(w, statusCode, payload)
+}
+
+// ValidationErrorJSON sends a JSON error with a generic message and an errors field mapping each invalid field
+// to what is wrong with it, so clients can highlight individual inputs. The status defaults to 400
+func (t *Tools) ValidationErrorJSON(w http.ResponseWriter, errs map[string]string, status ...int) error {
+	statusCode := http.StatusBadRequest
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	var payload JSONResponse
+	payload.Error = true
+	payload.Message = "the request contains invalid fields"
+	payload.Errors = errs
+
+	return t.WriteJSON(w, statusCode, payload)
+}
+
+// PushJSONToRemote posts arbitrary JSON data to the specified uri and returns the response, status code, and error.
+// The standard http.Client is used unless an optional one is supplied in the optional client parameter.
+// When using the standard client, RemoteTimeout (if set) is applied to the request.
+func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	return t.pushJSON(t.remoteClient(client...), uri, payload, nil)
+}
+
+// PushToRemote posts body to the specified uri with the given content type, e.g. for form encoded or raw
+// payloads, and returns the response, status code, and error exactly as PushJSONToRemote does. The same client
+// and RemoteTimeout rules apply. The body can only be resent after a 307 or 308 redirect when it is a
+// *bytes.Buffer, *bytes.Reader, or *strings.Reader
+func (t *Tools) PushToRemote(uri string, contentType string, body io.Reader, client ...*http.Client) (*http.Response, int, error) {
+	req, err := newPushRequest(uri, contentType, body, nil)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	return t.push(t.remoteClient(client...), req)
+}
+
+// PushOptions adjusts how PushJSONToRemoteWithOptions sends a request
+type PushOptions struct {
+	// IdempotencyKey is sent in an Idempotency-Key header, so that an upstream which honors the header can
+	// recognize repeats of the same request, e.g. when the caller retries after a timeout. When empty and
+	// Retries is set, a key is generated with GenerateToken
+	IdempotencyKey string
+	// Retries is how many more attempts are made after a network error or a 5xx response. Every attempt
+	// sends the same body and idempotency key
+	Retries int
+	// RetryDelay is how long to wait between attempts
+	RetryDelay time.Duration
+}
+
+// PushJSONToRemoteWithOptions posts arbitrary JSON data to the specified uri exactly like PushJSONToRemote,
+// with the behavior adjusted by opts. Sending an idempotency key only prevents duplicate side effects from
+// retries if the upstream honors the Idempotency-Key header. The response of the last attempt is returned
+func (t *Tools) PushJSONToRemoteWithOptions(uri string, data interface{}, opts PushOptions, client ...*http.Client) (*http.Response, int, error) {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	key := opts.IdempotencyKey
+	if key == "" && opts.Retries > 0 {
+		key, err = t.GenerateToken(16)
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+	}
+
+	header := http.Header{}
+	if key != "" {
+		header.Set("Idempotency-Key", key)
+	}
+
+	httpClient := t.remoteClient(client...)
+
+	for attempt := 0; ; attempt++ {
+		res, statusCode, err := t.pushJSON(httpClient, uri, payload, header)
+		if attempt >= opts.Retries || (err == nil && statusCode < http.StatusInternalServerError) {
+			return res, statusCode, err
+		}
+
+		time.Sleep(opts.RetryDelay)
+	}
+}
+
+// pushJSON posts the JSON payload to uri. Every request gets a fresh reader over payload, and GetBody returns
+// another, so the full body is sent again on each retry and after a 307 or 308 redirect
+func (t *Tools) pushJSON(httpClient *http.Client, uri string, payload []byte, header http.Header) (*http.Response, int, error) {
+	req, err := newPushRequest(uri, "application/json", bytes.NewReader(payload), header)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+
+	req.GetBody = func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(payload)), nil
+	}
+
+	return t.push(httpClient, req)
+}
+
+// newPushRequest builds a POST of body to uri with the given content type and any extra headers
+func newPushRequest(uri string, contentType string, body io.Reader, header http.Header) (*http.Request, error) {
+	req, err := http.NewRequest("POST", uri, body)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, value := range header {
+		req.Header[key] = value
+	}
+	req.Header.Set("Content-Type", contentType)
+
+	return req, nil
+}
+
+// push sends req, logging the outcome
+func (t *Tools) push(httpClient *http.Client, req *http.Request) (*http.Response, int, error) {
+	uri := req.URL.String()
+
+	start := time.Now()
+	res, err := httpClient.Do(req)
+	if err != nil {
+		t.logError("remote push failed", "uri", uri, "error", err, "latency", time.Since(start))
+		return nil, http.StatusBadRequest, err
+	}
+	defer res.Body.Close()
+
+	t.logInfo("remote push completed", "uri", uri, "status", res.StatusCode, "latency", time.Since(start))
+
+	return res, res.StatusCode, nil
+}
+
+// JSONDiff compares two JSON objects and returns a description of what changed between them. The
+// result contains three maps: "added" and "removed" hold the values of keys only present in new or
+// old respectively, and "changed" holds an {"old": ..., "new": ...} pair for each key whose value
+// differs. Nested objects are compared recursively and their keys reported using dot notation (e.g.
+// "address.city"); arrays and scalars are compared as whole values
+func (t *Tools) JSONDiff(old, new []byte) (map[string]interface{}, error) {
+	var oldDoc, newDoc map[string]interface{}
+
+	if err := json.Unmarshal(old, &oldDoc); err != nil {
+		return nil, fmt.Errorf("old document is not a valid JSON object: %s", err.Error())
+	}
+
+	if err := json.Unmarshal(new, &newDoc); err != nil {
+		return nil, fmt.Errorf("new document is not a valid JSON object: %s", err.Error())
+	}
+
+	added := make(map[string]interface{})
+	removed := make(map[string]interface{})
+	changed := make(map[string]interface{})
+
+	diffJSONObjects("", oldDoc, newDoc, added, removed, changed)
+
+	return map[string]interface{}{
+		"added":   added,
+		"removed": removed,
+		"changed": changed,
+	}, nil
+}
+
+// diffJSONObjects records the differences between two decoded JSON objects, recursing into keys
+// whose values are objects on both sides
+func diffJSONObjects(prefix string, old, new map[string]interface{}, added, removed, changed map[string]interface{}) {
+	for key, oldValue := range old {
+		fullKey := prefix + key
+
+		newValue, ok := new[key]
+		if !ok {
+			removed[fullKey] = oldValue
+			continue
+		}
+
+		oldObj, oldIsObj := oldValue.(map[string]interface{})
+		newObj, newIsObj := newValue.(map[string]interface{})
+		if oldIsObj && newIsObj {
+			diffJSONObjects(fullKey+".", oldObj, newObj, added, removed, changed)
+			continue
+		}
+
+		if !reflect.DeepEqual(oldValue, newValue) {
+			changed[fullKey] = map[string]interface{}{"old": oldValue, "new": newValue}
+		}
+	}
+
+	for key, newValue := range new {
+		if _, ok := old[key]; !ok {
+			added[prefix+key] = newValue
+		}
+	}
+}
+
+// ApplyMergePatch applies the JSON merge patch patch to the JSON document original, following RFC 7386: members
+// of a patch object replace those in the original, objects are merged recursively, a null removes the member,
+// and a patch that is not an object (including an array) replaces the original entirely. Numbers are kept
+// exactly as written, and the result has its object keys sorted
+func (t *Tools) ApplyMergePatch(original, patch []byte) ([]byte, error) {
+	target, err := decodeJSONValue(original)
+	if err != nil {
+		return nil, fmt.Errorf("original document is not valid JSON: %s", err.Error())
+	}
+
+	patchValue, err := decodeJSONValue(patch)
+	if err != nil {
+		return nil, fmt.Errorf("patch is not valid JSON: %s", err.Error())
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+
+	err = enc.Encode(mergePatch(target, patchValue))
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+// decodeJSONValue decodes a single JSON value of any type, keeping numbers as json.Number
+func decodeJSONValue(data []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after the JSON value")
+	}
+
+	return value, nil
+}
+
+// mergePatch implements the MergePatch function of RFC 7386, modifying target in place where it is an object
+func mergePatch(target, patch interface{}) interface{} {
+	patchObj, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]interface{})
+	if !ok {
+		targetObj = make(map[string]interface{})
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+			continue
+		}
+
+		targetObj[key] = mergePatch(targetObj[key], value)
+	}
+
+	return targetObj
+}
+
+// latinStopWords holds a handful of very common words used to tell apart languages written in the
+// Latin script
+var latinStopWords = map[string][]string{
+	"en": {"the", "and", "is", "of", "to", "in", "that", "it", "with", "for"},
+	"es": {"el", "la", "de", "que", "y", "en", "los", "es", "por", "con"},
+	"fr": {"le", "la", "les", "et", "est", "des", "un", "une", "que", "pour"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "mit", "ein", "zu", "den"},
+}
+
+// DetectLanguage makes a rough guess at the primary language of a text sample, returning an ISO 639-1
+// code or "unknown". The script is identified from the ranges the characters fall in (Cyrillic is
+// reported as "ru", kana as "ja", Han without kana as "zh", Hangul as "ko", and so on), and text in the
+// Latin script is narrowed down to English, Spanish, French, or German by counting common words.
+// This is a heuristic intended for routing, not an accurate classifier
+func (t *Tools) DetectLanguage(sample []byte) string {
+	counts := make(map[string]int)
+	letters := 0
+
+	for _, r := range string(sample) {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		letters++
+
+		switch {
+		case unicode.In(r, unicode.Hiragana, unicode.Katakana):
+			counts["ja"]++
+		case unicode.Is(unicode.Han, r):
+			counts["han"]++
+		case unicode.Is(unicode.Hangul, r):
+			counts["ko"]++
+		case unicode.Is(unicode.Cyrillic, r):
+			counts["ru"]++
+		case unicode.Is(unicode.Greek, r):
+			counts["el"]++
+		case unicode.Is(unicode.Arabic, r):
+			counts["ar"]++
+		case unicode.Is(unicode.Hebrew, r):
+			counts["he"]++
+		case unicode.Is(unicode.Latin, r):
+			counts["latin"]++
+		}
+	}
+
+	if letters == 0 {
+		return "unknown"
+	}
+
+	// Japanese text mixes kana with Han characters, so any meaningful amount of kana wins
+	if counts["ja"] > 0 && counts["ja"]*10 >= counts["han"] {
+		return "ja"
+	}
+
+	script, best := "", 0
+	for name, count := range counts {
+		if count > best {
+			script, best = name, count
+		}
+	}
+
+	switch script {
+	case "ja", "han":
+		if counts["ja"] > 0 {
+			return "ja"
+		}
+		return "zh"
+	case "latin":
+		return detectLatinLanguage(string(sample))
+	default:
+		return script
+	}
+}
+
+// detectLatinLanguage picks the language whose common words appear most often in s, or "unknown" if
+// none of them appear
+func detectLatinLanguage(s string) string {
+	words := strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	scores := make(map[string]int)
+	for _, word := range words {
+		for lang, stopWords := range latinStopWords {
+			for _, stopWord := range stopWords {
+				if word == stopWord {
+					scores[lang]++
+				}
+			}
+		}
+	}
+
+	lang, best := "unknown", 0
+	for _, candidate := range []string{"en", "es", "fr", "de"} {
+		if scores[candidate] > best {
+			lang, best = candidate, scores[candidate]
+		}
+	}
+
+	return lang
+}
+
+// contextKey is used for values the toolkit stores in a request context
+type contextKey string
+
+// apiVersionKey is the context key holding the API version negotiated by RequireAPIVersion
+const apiVersionKey contextKey = "apiVersion"
+
+// RequireAPIVersion returns middleware that rejects, with a 400 ErrorJSON response, any request whose
+// X-API-Version header is missing or not one of the supported versions. The accepted version is stored
+// in the request context and can be retrieved with APIVersionFromContext
+func (t *Tools) RequireAPIVersion(supported ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			version := strings.TrimSpace(r.Header.Get("X-API-Version"))
+			if version == "" {
+				_ = t.ErrorJSONForRequest(w, r, errors.New("the X-API-Version header is required"))
+				return
+			}
+
+			for _, v := range supported {
+				if v == version {
+					ctx := context.WithValue(r.Context(), apiVersionKey, version)
+					next.ServeHTTP(w, r.WithContext(ctx))
+					return
+				}
+			}
+
+			_ = t.ErrorJSONForRequest(w, r, fmt.Errorf("API version '%s' is not supported", version))
+		})
+	}
+}
+
+// APIVersionFromContext returns the API version stored by RequireAPIVersion, or an empty string if none
+func APIVersionFromContext(ctx context.Context) string {
+	version, _ := ctx.Value(apiVersionKey).(string)
+
+	return version
+}
+
+// requestIDKey is the context key holding the request ID set by RequestIDMiddleware
+const requestIDKey contextKey = "requestID"
+
+// requestIDPattern matches the incoming request IDs accepted by RequestIDMiddleware
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestIDMiddleware returns middleware that tags each request with an ID for tracing across services. The
+// X-Request-ID header of the request is used when present and made only of letters, digits, and ".-_:",
+// otherwise a new ID is generated with GenerateToken. The ID is stored in the request context, where it can
+// be retrieved with RequestIDFromContext, and echoed in the X-Request-ID header of the response
+func (t *Tools) RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			id, err = t.GenerateToken(16)
+			if err != nil {
+				_ = t.ErrorJSONForRequest(w, r, errors.New("could not generate a request ID"), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(r.Context(), requestIDKey, id)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequestIDFromContext returns the request ID stored by RequestIDMiddleware, or an empty string if none
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+
+	return id
+}
+
+// inflightRequest tracks a request being handled by SingleflightMiddleware, so that identical requests
+// arriving meanwhile can wait for and share its response
+type inflightRequest struct {
+	wg       sync.WaitGroup
+	response *bufferedResponse
+}
+
+// bufferedResponse is an http.ResponseWriter that holds the response in memory so it can be replayed
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponse) Write(p []byte) (int, error) {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// finish records a 200 status for a handler that wrote nothing, so the response can be replayed without
+// being modified
+func (b *bufferedResponse) finish() {
+	if b.status == 0 {
+		b.status = http.StatusOK
+	}
+}
+
+// writeTo replays the finished buffered response to w. It only reads b, so several requests can replay the same
+// response at once
+func (b *bufferedResponse) writeTo(w http.ResponseWriter) {
+	for key, value := range b.header {
+		w.Header()[key] = append([]string(nil), value...)
+	}
+
+	w.WriteHeader(b.status)
+
+	_, _ = w.Write(b.body.Bytes())
+}
+
+// SingleflightMiddleware returns middleware that coalesces concurrent identical GET requests, so the
+// wrapped handler runs once and every caller receives a copy of the same buffered response. Requests
+// are considered identical when keyFn returns the same key for them; an empty key disables coalescing
+// for that request, as does any method other than GET
+func (t *Tools) SingleflightMiddleware(keyFn func(*http.Request) string) func(http.Handler) http.Handler {
+	var mu sync.Mutex
+	inflight := make(map[string]*inflightRequest)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodGet {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := keyFn(r)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			mu.Lock()
+			if call, ok := inflight[key]; ok {
+				mu.Unlock()
+				call.wg.Wait()
+				call.response.writeTo(w)
+				return
+			}
+
+			call := &inflightRequest{response: &bufferedResponse{header: make(http.Header)}}
+			call.wg.Add(1)
+			inflight[key] = call
+			mu.Unlock()
+
+			func() {
+				// release any waiting requests even if the handler panics, giving them a 500, and then
+				// let the panic continue
+				defer func() {
+					p := recover()
+					if p != nil {
+						call.response = &bufferedResponse{header: make(http.Header), status: http.StatusInternalServerError}
+						call.response.header.Set("Content-Type", "text/plain; charset=utf-8")
+						call.response.body.WriteString(http.StatusText(http.StatusInternalServerError))
+					}
+					call.response.finish()
+
+					mu.Lock()
+					delete(inflight, key)
+					mu.Unlock()
+					call.wg.Done()
+
+					if p != nil {
+						panic(p)
+					}
+				}()
+
+				next.ServeHTTP(call.response, r)
+			}()
+
+			call.response.writeTo(w)
+		})
+	}
+}
+
+// GetJSONFromRemote issues a GET request to the specified uri and decodes the JSON response body into target,
+// returning the response status code and potentially an error. Responses with a non-2xx status are not decoded.
+// The body is decoded with DecodeJSON using MaxJSONSize and AllowUnknownFields, so the same limits and error
+// messages apply as for ReadJSON. The standard http.Client is used unless one is supplied in the optional client
+// parameter.
+func (t *Tools) GetJSONFromRemote(uri string, target interface{}, client ...*http.Client) (int, error) {
+	req, err := http.NewRequest("GET", uri, nil)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := t.remoteClient(client...).Do(req)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("remote service returned status %d", res.StatusCode)
+	}
+
+	err = DecodeJSON(res.Body, target, t.MaxJSONSize, t.AllowUnknownFields)
+	if err != nil {
+		return res.StatusCode, err
+	}
+
+	return res.StatusCode, nil
+}
+
+// ProxyJSON forwards the JSON body of r to uri in a POST request, and relays the status and body of the response
+// back to the client, e.g. for a thin API gateway. Both bodies are limited to MaxJSONSize. If the inbound body is
+// too large, or the remote service can't be reached or its response is too large, a JSON error is written with
+// ErrorJSONForRequest instead and the error returned. The remote request is bound to the context of r, and
+// carries the request ID set by RequestIDMiddleware, if any
+func (t *Tools) ProxyJSON(w http.ResponseWriter, r *http.Request, uri string, client ...*http.Client) error {
+	maxBytes := 1024 * 1024
+	if t.MaxJSONSize != 0 {
+		maxBytes = t.MaxJSONSize
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, int64(maxBytes)))
+	if err != nil {
+		err = describeJSONError(err, maxBytes)
+		if errors.Is(err, ErrBodyTooLarge) {
+			_ = t.ErrorJSONForRequest(w, r, err, http.StatusRequestEntityTooLarge)
+		} else {
+			_ = t.ErrorJSONForRequest(w, r, err)
+		}
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(r.Context(), "POST", uri, bytes.NewReader(body))
+	if err != nil {
+		_ = t.ErrorJSONForRequest(w, r, err, http.StatusInternalServerError)
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if id := RequestIDFromContext(r.Context()); id != "" {
+		req.Header.Set("X-Request-ID", id)
+	}
+
+	res, err := t.remoteClient(client...).Do(req)
+	if err != nil {
+		_ = t.ErrorJSONForRequest(w, r, errors.New("the upstream service could not be reached"), http.StatusBadGateway)
+		return err
+	}
+	defer res.Body.Close()
+
+	// read one byte past the limit so an oversized response can be detected
+	upstream, err := io.ReadAll(io.LimitReader(res.Body, int64(maxBytes)+1))
+	if err != nil {
+		_ = t.ErrorJSONForRequest(w, r, errors.New("the upstream response could not be read"), http.StatusBadGateway)
+		return err
+	}
+
+	if len(upstream) > maxBytes {
+		err = fmt.Errorf("upstream response must not be larger than %d bytes", maxBytes)
+		_ = t.ErrorJSONForRequest(w, r, err, http.StatusBadGateway)
+		return err
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/json"
+	}
+
+	return t.writeBody(w, res.StatusCode, contentType, upstream)
+}
+
+// remoteClient returns the supplied client if there is one, otherwise a standard http.Client using RemoteTimeout
+func (t *Tools) remoteClient(client ...*http.Client) *http.Client {
+	if len(client) > 0 {
+		return client[0]
+	}
+
+	return &http.Client{Timeout: t.RemoteTimeout}
+}
+
+// maxReceiptSnippet is the most bytes of a remote response body kept in a DeliveryReceipt
+const maxReceiptSnippet = 1024
+
+// DeliveryReceipt records the outcome of pushing JSON to a remote service
+type DeliveryReceipt struct {
+	AttemptedAt     time.Time     `json:"attempted_at"`
+	StatusCode      int           `json:"status_code"`
+	Latency         time.Duration `json:"latency"`
+	ResponseSnippet string        `json:"response_snippet"`
+}
+
+// PushJSONToRemoteWithReceipt posts arbitrary JSON data to the specified uri like PushJSONToRemote, but
+// returns a DeliveryReceipt recording when the attempt was made, the status code, how long the remote took
+// to respond, and up to the first 1024 bytes of the response body. A receipt is returned even on error, with
+// whatever was recorded before the failure
+func (t *Tools) PushJSONToRemoteWithReceipt(uri string, data interface{}, client ...*http.Client) (DeliveryReceipt, error) {
+	receipt := DeliveryReceipt{AttemptedAt: time.Now()}
+
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return receipt, err
+	}
+
+	req, err := http.NewRequest("POST", uri, bytes.NewReader(payload))
+	if err != nil {
+		return receipt, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := t.remoteClient(client...).Do(req)
+	receipt.Latency = time.Since(receipt.AttemptedAt)
+	if err != nil {
+		t.logError("remote push failed", "uri", uri, "error", err, "latency", receipt.Latency)
+		return receipt, err
+	}
+	defer res.Body.Close()
+
+	receipt.StatusCode = res.StatusCode
+	t.logInfo("remote push completed", "uri", uri, "status", res.StatusCode, "latency", receipt.Latency)
+
+	snippet, err := io.ReadAll(io.LimitReader(res.Body, maxReceiptSnippet))
+	receipt.ResponseSnippet = string(snippet)
+	if err != nil {
+		return receipt, err
+	}
+
+	return receipt, nil
+}
+
+// uploadTokenClaims holds the constraints embedded in a presigned upload token
+type uploadTokenClaims struct {
+	MaxSize      int64    `json:"max_size"`
+	AllowedTypes []string `json:"allowed_types,omitempty"`
+	Expires      int64    `json:"expires"`
+}
+
+// CreateUploadToken returns a token, signed with secret using HMAC-SHA256, that authorizes uploads through
+// HandlePresignedUpload until it expires after ttl. Tokens are not single use: one can be presented any number
+// of times before it expires, so keep ttl short. The token embeds the maximum size of each file and the file
+// types allowed, which can only narrow AllowedFileTypes; an empty list leaves AllowedFileTypes in force. The
+// token is URL safe, so it can be handed to a browser as a query parameter. maxSize must be greater than zero
+func (t *Tools) CreateUploadToken(maxSize int64, allowedTypes []string, ttl time.Duration, secret []byte) (string, error) {
+	if maxSize <= 0 {
+		return "", errors.New("the maximum upload size must be greater than zero")
+	}
+
+	claims, err := json.Marshal(uploadTokenClaims{
+		MaxSize:      maxSize,
+		AllowedTypes: allowedTypes,
+		Expires:      time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(claims)
+
+	return payload + "." + signUploadToken(payload, secret), nil
+}
+
+// signUploadToken returns the URL safe base64 HMAC-SHA256 signature of an encoded upload token payload
+func signUploadToken(payload string, secret []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(payload))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// verifyUploadToken checks the signature and expiry of a token created by CreateUploadToken and returns its claims
+func verifyUploadToken(token string, secret []byte) (*uploadTokenClaims, error) {
+	payload, signature, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, errors.New("malformed upload token")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(signUploadToken(payload, secret))) {
+		return nil, errors.New("invalid upload token signature")
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errors.New("malformed upload token")
+	}
+
+	var claims uploadTokenClaims
+	if err = json.Unmarshal(decoded, &claims); err != nil {
+		return nil, errors.New("malformed upload token")
+	}
+
+	if time.Now().Unix() > claims.Expires {
+		return nil, errors.New("upload token has expired")
+	}
+
+	if claims.MaxSize <= 0 {
+		return nil, errors.New("malformed upload token")
+	}
+
+	return &claims, nil
+}
+
+// HandlePresignedUpload stores files uploaded with a token created by CreateUploadToken, passed in the "token"
+// query parameter. Requests with a missing, invalid, or expired token are rejected with a 403, and files that
+// exceed the size or type constraints embedded in the token are rejected with a 400. The token can only narrow
+// MaxFileSize, never raise it. On success the list of UploadedFile is written to the client as the data of a
+// JSONResponse
+func (t *Tools) HandlePresignedUpload(w http.ResponseWriter, r *http.Request, secret []byte, uploadDir string) {
+	claims, err := verifyUploadToken(r.URL.Query().Get("token"), secret)
+	if err != nil {
+		_ = t.ErrorJSONForRequest(w, r, err, http.StatusForbidden)
+		return
+	}
+
+	// apply the token's constraints without altering the shared Tools
+	tokenTools := *t
+	if t.MaxFileSize <= 0 || claims.MaxSize < int64(t.MaxFileSize) {
+		tokenTools.MaxFileSize = int(claims.MaxSize)
+	}
+
+	allowedTypes, ok := intersectFileTypes(t.AllowedFileTypes, claims.AllowedTypes)
+	if !ok {
+		_ = t.ErrorJSONForRequest(w, r, errors.New("the upload token does not permit any of the allowed file types"))
+		return
+	}
+	tokenTools.AllowedFileTypes = allowedTypes
+
+	files, err := tokenTools.UploadFiles(r, uploadDir)
+	if err != nil {
+		_ = t.ErrorJSONForRequest(w, r, err)
+		return
+	}
+
+	_ = t.WriteJSON(w, http.StatusCreated, JSONResponse{Message: "upload complete", Data: files})
+}
+
+// intersectFileTypes returns the file type patterns, in the form of AllowedFileTypes, that are permitted by both
+// a and b, where an empty list permits every type. ok is false when the lists have no type in common
+func intersectFileTypes(a, b []string) ([]string, bool) {
+	if len(a) == 0 {
+		return b, true
+	}
+
+	if len(b) == 0 {
+		return a, true
+	}
+
+	// a pattern is kept when the other list covers it, so "image/png" and "image/*" intersect to "image/png"
+	var both []string
+	seen := make(map[string]bool)
+	for _, patterns := range [][2][]string{{a, b}, {b, a}} {
+		for _, pattern := range patterns[0] {
+			key := strings.ToLower(strings.TrimSpace(pattern))
+			if !seen[key] && matchesFileType(pattern, patterns[1]) {
+				seen[key] = true
+				both = append(both, pattern)
+			}
+		}
+	}
+
+	return both, len(both) > 0
+}
+
+// CORSConfig describes the cross-origin requests allowed by CORSMiddleware
+type CORSConfig struct {
+	// AllowedOrigins lists the origins permitted to make requests, e.g. "https://example.com". An entry
+	// of "*" permits any origin
+	AllowedOrigins []string
+	// AllowedMethods lists the methods permitted in preflight responses.
+	// Defaults to GET, POST, PUT, PATCH, DELETE, and OPTIONS
+	AllowedMethods []string
+	// AllowedHeaders lists the request headers permitted in preflight responses.
+	// Defaults to Accept, Authorization, and Content-Type
+	AllowedHeaders []string
+	// AllowCredentials permits cookies and HTTP authentication on cross-origin requests from the origins listed
+	// in AllowedOrigins. Origins matched only by a "*" entry never receive it: allowing credentials from every
+	// origin would let any site act as the signed in user, so "*" is sent without credentials instead
+	AllowCredentials bool
+	// MaxAge is how long, in seconds, browsers may cache a preflight response. Zero omits the header
+	MaxAge int
+}
+
+// SetCORSHeaders sets the headers allowing origin to make requests with the supplied methods
+func (t *Tools) SetCORSHeaders(w http.ResponseWriter, origin string, methods []string) {
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if origin != "*" {
+		addVary(w.Header(), "Origin")
+	}
+
+	if len(methods) > 0 {
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	}
+}
+
+// CORSMiddleware returns middleware that applies the CORS rules configured in Tools.CORS. Preflight
+// requests are answered with a 204 (or a 403 for origins that are not allowed) without calling next.
+// Other requests from origins that are not allowed are passed to next without any CORS headers, so the
+// browser will refuse to expose the response
+func (t *Tools) CORSMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// the response depends on the origin even when it is refused, so caches must not share it between origins
+		addVary(w.Header(), "Origin")
+
+		allowedOrigin, ok := t.CORS.allowedOrigin(origin)
+		credentials := t.CORS.AllowCredentials && allowedOrigin != "*"
+		if !ok {
+			if preflight {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !preflight {
+			t.SetCORSHeaders(w, allowedOrigin, nil)
+			if credentials {
+				w.Header().Set("Access-Control-Allow-Credentials", "true")
+			}
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		methods := t.CORS.AllowedMethods
+		if len(methods) == 0 {
+			methods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+		}
+
+		headers := t.CORS.AllowedHeaders
+		if len(headers) == 0 {
+			headers = []string{"Accept", "Authorization", "Content-Type"}
+		}
+
+		t.SetCORSHeaders(w, allowedOrigin, methods)
+		w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+
+		if credentials {
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if t.CORS.MaxAge > 0 {
+			w.Header().Set("Access-Control-Max-Age", strconv.Itoa(t.CORS.MaxAge))
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// allowedOrigin reports whether origin may make requests, and the value to send in the
+// Access-Control-Allow-Origin header
+func (c CORSConfig) allowedOrigin(origin string) (string, bool) {
+	wildcard := false
+	for _, allowed := range c.AllowedOrigins {
+		if allowed == "*" {
+			wildcard = true
+		}
+
+		if strings.EqualFold(allowed, origin) {
+			return origin, true
+		}
+	}
+
+	if wildcard {
+		return "*", true
+	}
+
+	return "", false
+}
+
+// SecurityHeadersConfig describes the headers set by SecurityHeadersMiddleware. X-Content-Type-Options is always
+// set to nosniff
+type SecurityHeadersConfig struct {
+	// FrameOptions is the X-Frame-Options header, controlling whether pages may be framed. Defaults to DENY
+	FrameOptions string
+	// ReferrerPolicy is the Referrer-Policy header. Defaults to strict-origin-when-cross-origin
+	ReferrerPolicy string
+	// HSTSMaxAge is how long, in seconds, browsers should only use HTTPS for the site, sent as the
+	// Strict-Transport-Security header on TLS requests. Zero omits the header
+	HSTSMaxAge int
+	// HSTSIncludeSubdomains extends Strict-Transport-Security to every subdomain
+	HSTSIncludeSubdomains bool
+}
+
+// SecurityHeadersMiddleware returns middleware that sets baseline security headers, configured by
+// Tools.SecurityHeaders, on every response. Strict-Transport-Security is only sent on requests made over TLS,
+// as browsers ignore it on plain HTTP
+func (t *Tools) SecurityHeadersMiddleware(next http.Handler) http.Handler {
+	config := t.SecurityHeaders
+
+	frameOptions := config.FrameOptions
+	if frameOptions == "" {
+		frameOptions = "DENY"
+	}
+
+	referrerPolicy := config.ReferrerPolicy
+	if referrerPolicy == "" {
+		referrerPolicy = "strict-origin-when-cross-origin"
+	}
+
+	var hsts string
+	if config.HSTSMaxAge > 0 {
+		hsts = fmt.Sprintf("max-age=%d", config.HSTSMaxAge)
+		if config.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("X-Frame-Options", frameOptions)
+		w.Header().Set("Referrer-Policy", referrerPolicy)
+
+		if hsts != "" && r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ReadPagination reads the page and page_size query parameters of a request, returning the page (starting at 1),
+// the page size, and the offset of the first item on the page. A missing page defaults to 1 and a missing page
+// size to defaultSize, and page sizes larger than maxSize are reduced to maxSize, unless maxSize is zero.
+// Non-numeric values, pages below 1, page sizes below 1, and pages so far in that the offset would overflow are
+// rejected with an error, as is a defaultSize below 1 or above maxSize
+func (t *Tools) ReadPagination(r *http.Request, defaultSize, maxSize int) (int, int, int, error) {
+	if defaultSize < 1 || (maxSize > 0 && defaultSize > maxSize) {
+		return 0, 0, 0, fmt.Errorf("the default page size must be between 1 and the maximum page size, got %d", defaultSize)
+	}
+
+	query := r.URL.Query()
+	page, size := 1, defaultSize
+
+	if value := query.Get("page"); value != "" {
+		p, err := strconv.Atoi(value)
+		if err != nil || p < 1 {
+			return 0, 0, 0, fmt.Errorf("page must be a positive integer, got '%s'", value)
+		}
+		page = p
+	}
+
+	if value := query.Get("page_size"); value != "" {
+		s, err := strconv.Atoi(value)
+		if err != nil || s < 1 {
+			return 0, 0, 0, fmt.Errorf("page_size must be a positive integer, got '%s'", value)
+		}
+		size = s
+	}
+
+	if maxSize > 0 && size > maxSize {
+		size = maxSize
+	}
+
+	if page-1 > math.MaxInt/size {
+		return 0, 0, 0, fmt.Errorf("page %d is too large for a page size of %d", page, size)
+	}
+
+	return page, size, (page - 1) * size, nil
+}
+
+// QueryString returns the query parameter key of a request, or def when it is missing or empty
+func (t *Tools) QueryString(r *http.Request, key, def string) string {
+	if value := r.URL.Query().Get(key); value != "" {
+		return value
+	}
+
+	return def
+}
+
+// QueryInt returns the query parameter key of a request as an int, or def when it is missing or not an integer
+func (t *Tools) QueryInt(r *http.Request, key string, def int) int {
+	value, err := strconv.Atoi(r.URL.Query().Get(key))
+	if err != nil {
+		return def
+	}
+
+	return value
+}
+
+// QueryBool returns the query parameter key of a request as a bool, accepting the values understood by
+// strconv.ParseBool, e.g. "true", "1", or "false", or def when it is missing or invalid
+func (t *Tools) QueryBool(r *http.Request, key string, def bool) bool {
+	value, err := strconv.ParseBool(r.URL.Query().Get(key))
+	if err != nil {
+		return def
+	}
+
+	return value
+}
+
+// RateLimitConfig describes the token bucket used by RateLimitMiddleware for each client
+type RateLimitConfig struct {
+	// Rate is how many requests per second each client may make on average. Defaults to 10
+	Rate float64
+	// Burst is how many requests a client may make in quick succession before being limited. Defaults to 20
+	Burst int
+	// IdleTimeout is how long a client's bucket is kept after its last request. Defaults to 10 minutes
+	IdleTimeout time.Duration
+	// TrustedProxies lists the proxies, as IP addresses or CIDR ranges, whose forwarding headers are believed
+	// when identifying clients, exactly as for ClientIP. When empty, clients are identified by RemoteAddr
+	TrustedProxies []string
+}
+
+// tokenBucket tracks the requests remaining for a single client
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// RateLimitMiddleware returns middleware that limits each client, identified by ClientIP, to the rate
+// configured in Tools.RateLimit using a token bucket. Clients that exceed the limit receive a 429 JSON error
+// with a Retry-After header. Buckets for clients that have been idle longer than IdleTimeout are discarded
+func (t *Tools) RateLimitMiddleware(next http.Handler) http.Handler {
+	rate, burst, idleTimeout := t.RateLimit.Rate, float64(t.RateLimit.Burst), t.RateLimit.IdleTimeout
+	if rate <= 0 {
+		rate = 10
+	}
+	if burst <= 0 {
+		burst = 20
+	}
+	if idleTimeout <= 0 {
+		idleTimeout = 10 * time.Minute
+	}
+
+	var mu sync.Mutex
+	buckets := make(map[string]*tokenBucket)
+	lastSweep := time.Now()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := t.ClientIP(r, t.RateLimit.TrustedProxies)
+		now := time.Now()
+
+		mu.Lock()
+
+		if now.Sub(lastSweep) > idleTimeout {
+			for key, bucket := range buckets {
+				if now.Sub(bucket.lastSeen) > idleTimeout {
+					delete(buckets, key)
+				}
+			}
+			lastSweep = now
+		}
+
+		bucket, ok := buckets[ip]
+		if !ok {
+			bucket = &tokenBucket{tokens: burst, lastSeen: now}
+			buckets[ip] = bucket
+		}
+
+		bucket.tokens += now.Sub(bucket.lastSeen).Seconds() * rate
+		if bucket.tokens > burst {
+			bucket.tokens = burst
+		}
+		bucket.lastSeen = now
+
+		allowed := bucket.tokens >= 1
+		if allowed {
+			bucket.tokens--
+		}
+		wait := (1 - bucket.tokens) / rate
+
+		mu.Unlock()
+
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait))))
+			_ = t.ErrorJSONForRequest(w, r, errors.New("too many requests"), http.StatusTooManyRequests)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ClientIP returns the IP address of the client making a request. X-Forwarded-For and X-Real-IP are only
+// believed when the immediate peer (r.RemoteAddr) is one of trustedProxies, which may be IP addresses or CIDR
+// ranges, so clients can't spoof their address by sending the headers themselves. Forwarded chains are walked
+// from the nearest hop, skipping trusted proxies, and the first untrusted address is returned
+func (t *Tools) ClientIP(r *http.Request, trustedProxies []string) string {
+	peer := hostIP(r.RemoteAddr)
+
+	if !isTrustedProxy(peer, trustedProxies) {
+		return peer
+	}
+
+	var chain []string
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		for _, hop := range strings.Split(forwarded, ",") {
+			chain = append(chain, hostIP(strings.TrimSpace(hop)))
+		}
+	} else if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); realIP != "" {
+		chain = append(chain, hostIP(realIP))
+	}
+
+	client := peer
+	for i := len(chain) - 1; i >= 0; i-- {
+		if net.ParseIP(chain[i]) == nil {
+			// the chain can't be trusted beyond a malformed entry
+			break
+		}
+
+		client = chain[i]
+		if !isTrustedProxy(client, trustedProxies) {
+			break
+		}
+	}
+
+	return client
+}
+
+// isTrustedProxy reports whether ip is one of trustedProxies, which may be IP addresses or CIDR ranges
+func isTrustedProxy(ip string, trustedProxies []string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, proxy := range trustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(parsed) {
+				return true
+			}
+			continue
+		}
+
+		if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedHostPattern matches the host names and ports accepted from X-Forwarded-Host
+var forwardedHostPattern = regexp.MustCompile(`^[A-Za-z0-9.\-]+(:[0-9]+)?$|^\[[0-9A-Fa-f:.]+\](:[0-9]+)?$`)
+
+// AbsoluteURL returns the externally visible URL of path on the server handling r, e.g. for download or
+// pagination links. The scheme comes from whether r was made over TLS and the host from r.Host, unless the
+// immediate peer is one of trustedProxies (as for ClientIP), in which case X-Forwarded-Proto and
+// X-Forwarded-Host are honored when they hold a valid scheme and host
+func (t *Tools) AbsoluteURL(r *http.Request, path string, trustedProxies []string) string {
+	scheme, host := "http", r.Host
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	if isTrustedProxy(hostIP(r.RemoteAddr), trustedProxies) {
+		proto, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+		if proto = strings.ToLower(strings.TrimSpace(proto)); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+
+		forwardedHost, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+		if forwardedHost = strings.TrimSpace(forwardedHost); forwardedHostPattern.MatchString(forwardedHost) {
+			host = forwardedHost
+		}
+	}
+
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	return scheme + "://" + host + path
+}
+
+// hostIP strips any port, and the brackets around an IPv6 address, from addr
+func hostIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// SignPayload returns the hex encoded HMAC-SHA256 signature of body using secret, e.g. for signing
+// outgoing webhooks
+func (t *Tools) SignPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignature reports whether signature is the hex encoded HMAC-SHA256 signature of body using secret,
+// comparing in constant time. A leading "sha256=", as sent by some webhook providers, is ignored
+func (t *Tools) VerifySignature(secret string, body []byte, signature string) bool {
+	signature = strings.TrimPrefix(signature, "sha256=")
+
+	return hmac.Equal([]byte(signature), []byte(t.SignPayload(secret, body)))
+}
+
+// ErrMissingAuthorization is returned by BearerToken when a request has no Authorization header, and
+// ErrInvalidAuthorization when the header does not hold a single bearer token
+var (
+	ErrMissingAuthorization = errors.New("request has no Authorization header")
+	ErrInvalidAuthorization = errors.New("authorization header is not a valid bearer token")
+)
+
+// BearerToken returns the token from an "Authorization: Bearer <token>" request header. The scheme is matched
+// case-insensitively and surrounding whitespace is trimmed from the token. ErrMissingAuthorization is returned
+// when there is no header, and ErrInvalidAuthorization when it uses another scheme or holds no single token
+func (t *Tools) BearerToken(r *http.Request) (string, error) {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if header == "" {
+		return "", ErrMissingAuthorization
+	}
+
+	scheme, token, _ := strings.Cut(header, " ")
+	token = strings.TrimSpace(token)
+	if !strings.EqualFold(scheme, "Bearer") || token == "" || strings.ContainsAny(token, " \t") {
+		return "", ErrInvalidAuthorization
+	}
+
+	return token, nil
+}
+
+// FlexTimeLayouts are the layouts FlexTime tries, in order, when decoding a timestamp. Replace or extend it to
+// accept the formats sent by particular clients; it should not be changed while JSON is being decoded
+var FlexTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+// FlexTime is a time.Time that decodes from JSON strings in any of FlexTimeLayouts, e.g. "2006-01-02 15:04:05",
+// rather than only RFC 3339. It encodes as RFC 3339, and null decodes to the zero time. Timestamps without a
+// time zone are taken to be UTC
+type FlexTime struct {
+	time.Time
+}
+
+func (ft *FlexTime) UnmarshalJSON(b []byte) error {
+	if string(b) == "null" {
+		ft.Time = time.Time{}
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("timestamp must be a JSON string, not %s", b)
+	}
+
+	for _, layout := range FlexTimeLayouts {
+		if parsed, err := time.Parse(layout, s); err == nil {
+			ft.Time = parsed
+			return nil
+		}
+	}
+
+	return fmt.Errorf("timestamp %q is not in a recognized format", s)
+}
+
+// ErrUploadNotFound is returned by AppendChunk and HeadUpload for an ID that is unknown or whose upload has
+// completed or expired, and ErrOffsetMismatch by AppendChunk when a chunk is not sent from the offset that
+// HeadUpload reports
+var (
+	ErrUploadNotFound = errors.New("resumable upload not found")
+	ErrOffsetMismatch = errors.New("chunk offset does not match the bytes received so far")
+)
+
+// resumableUploadInfo is the metadata of a resumable upload, saved as <id>.json in ResumableUploadDir
+type resumableUploadInfo struct {
+	Dir       string    `json:"dir"`
+	TotalSize int64     `json:"total_size"`
+	FileType  string    `json:"file_type,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	// TTL is the ResumableUploadTTL of the Tools that created the upload
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// resumableUploadLocks serializes the chunks appended to each resumable upload, keyed by ID. A lock is dropped
+// once its upload completes, expires, or turns out not to exist
+var resumableUploadLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+// lockResumableUpload locks the upload id, returning the function that unlocks it
+func lockResumableUpload(id string) func() {
+	resumableUploadLocks.Lock()
+	lock, ok := resumableUploadLocks.locks[id]
+	if !ok {
+		lock = new(sync.Mutex)
+		resumableUploadLocks.locks[id] = lock
+	}
+	resumableUploadLocks.Unlock()
+
+	lock.Lock()
+
+	return lock.Unlock
+}
+
+// CreateUpload starts a resumable upload of totalSize bytes to uploadDir, returning an ID to pass to
+// AppendChunk and HeadUpload. The data is gathered in uploadDir/<id>.part, with its metadata kept in
+// ResumableUploadDir, so an upload can be resumed by a process other than the one that created it. The same
+// BaseUploadDir, MaxFileSize, and file type rules as UploadFiles apply. Uploads that receive no chunk for
+// the ResumableUploadTTL they were created with are deleted
+func (t *Tools) CreateUpload(uploadDir string, totalSize int64) (string, error) {
+	err := t.ValidateConfig()
+	if err != nil {
+		return "", err
+	}
+
+	if totalSize <= 0 {
+		return "", errors.New("the upload size must be greater than zero")
+	}
+
+	if t.MaxFileSize > 0 && totalSize > int64(t.MaxFileSize) {
+		return "", errors.New("the uploaded file is too large")
+	}
+
+	err = t.checkUploadDir(uploadDir)
+	if err != nil {
+		return "", err
+	}
+
+	err = t.CreateDirIfNotExists(uploadDir)
+	if err != nil {
+		return "", errors.New("cannot create/utilize upload directory")
+	}
+
+	metadataDir := t.resumableUploadDir()
+
+	err = t.CreateDirIfNotExists(metadataDir)
+	if err != nil {
+		return "", errors.New("cannot create/utilize resumable upload directory")
+	}
+
+	t.expireResumableUploads(metadataDir)
+
+	id, err := t.GenerateToken(16)
+	if err != nil {
+		return "", err
+	}
+
+	partial, err := os.OpenFile(filepath.Join(uploadDir, id+".part"), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", err
+	}
+
+	err = partial.Close()
+	if err != nil {
+		return "", err
+	}
+
+	info := resumableUploadInfo{Dir: uploadDir, TotalSize: totalSize, CreatedAt: time.Now(), TTL: t.resumableUploadTTL()}
+
+	err = t.saveResumableUpload(id, info)
+	if err != nil {
+		_ = os.Remove(filepath.Join(uploadDir, id+".part"))
+		return "", err
+	}
+
+	return id, nil
+}
+
+// AppendChunk adds the data read from r to the resumable upload id, returning the new offset. offset must be
+// the number of bytes received so far, as reported by HeadUpload, or ErrOffsetMismatch is returned; this stops
+// a chunk that is sent twice from being stored twice. If r fails part way, whatever was read is kept, so the
+// client can resume from the offset HeadUpload reports. A chunk that extends past the total size is discarded
+// and an error returned. See AppendChunkFile to learn the name of the completed file
+func (t *Tools) AppendChunk(id string, offset int64, r io.Reader) (int64, error) {
+	current, _, err := t.AppendChunkFile(id, offset, r)
+
+	return current, err
+}
+
+// AppendChunkFile is AppendChunk, but also returns the completed file once the last chunk has arrived, and nil
+// before then. The type of the upload is checked against AllowedFileTypes and DisallowedFileTypes as soon as
+// the first chunk arrives, and the whole file is checked again when it is complete. The completed file is
+// named after its ID and the extension of its type, e.g. <id>.png, the metadata is removed, and the ID is no
+// longer known to HeadUpload. An upload that fails the final check is deleted
+func (t *Tools) AppendChunkFile(id string, offset int64, r io.Reader) (int64, *UploadedFile, error) {
+	unlock := lockResumableUpload(id)
+	defer unlock()
+
+	info, err := t.loadResumableUpload(id)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	partialName := filepath.Join(info.Dir, id+".part")
+
+	current, err := fileSize(partialName)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if offset != current {
+		return current, nil, ErrOffsetMismatch
+	}
+
+	if current == 0 {
+		// the first chunk is sniffed so that a disallowed file is refused before any more of it is sent
+		head := make([]byte, 512)
+		n, err := io.ReadFull(r, head)
+		if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return current, nil, err
+		}
+
+		if n == 0 {
+			return current, nil, nil
+		}
+
+		info.FileType, err = t.detectFileType(head[:n], id)
+		if err != nil {
+			return current, nil, err
+		}
+
+		err = t.saveResumableUpload(id, info)
+		if err != nil {
+			return current, nil, err
+		}
+
+		r = io.MultiReader(bytes.NewReader(head[:n]), r)
+	}
+
+	partial, err := os.OpenFile(partialName, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return current, nil, err
+	}
+
+	// one byte more than the upload still needs is copied, so that a chunk running past the end is noticed
+	// however r splits up its data
+	remaining := info.TotalSize - current
+	n, err := io.Copy(partial, io.LimitReader(r, remaining+1))
+	if closeErr := partial.Close(); err == nil {
+		err = closeErr
+	}
+
+	if n > remaining {
+		truncateErr := os.Truncate(partialName, offset)
+		if truncateErr != nil {
+			return offset, nil, truncateErr
+		}
+
+		return offset, nil, errors.New("the chunk extends past the size of the upload")
+	}
+
+	current += n
+	if err != nil {
+		return current, nil, err
+	}
+
+	if current < info.TotalSize {
+		return current, nil, nil
+	}
+
+	file, err := t.completeResumableUpload(id, info)
+	if err != nil {
+		return current, nil, err
+	}
+
+	return current, file, nil
+}
+
+// HeadUpload returns how many bytes of the resumable upload id have been received, which is the offset to send
+// the next chunk from, and its total size
+func (t *Tools) HeadUpload(id string) (int64, int64, error) {
+	unlock := lockResumableUpload(id)
+	defer unlock()
+
+	info, err := t.loadResumableUpload(id)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	offset, err := fileSize(filepath.Join(info.Dir, id+".part"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return offset, info.TotalSize, nil
+}
+
+// completeResumableUpload checks the fully received upload id and renames it into place
+func (t *Tools) completeResumableUpload(id string, info resumableUploadInfo) (*UploadedFile, error) {
+	partialName := filepath.Join(info.Dir, id+".part")
+
+	partial, err := os.Open(partialName)
+	if err != nil {
+		return nil, err
+	}
+
+	fileType, err := t.checkFileType(partial, id)
+	_ = partial.Close()
+	if err != nil {
+		t.removeResumableUpload(id, info)
+		return nil, err
+	}
+
+	name := id + extensionForType(fileType)
+
+	err = os.Rename(partialName, filepath.Join(info.Dir, name))
+	if err != nil {
+		return nil, err
+	}
+
+	t.removeResumableUpload(id, info)
+
+	return &UploadedFile{NewFileName: name, FileSize: info.TotalSize, Path: name}, nil
+}
+
+// resumableUploadDir returns the directory holding the metadata of resumable uploads
+func (t *Tools) resumableUploadDir() string {
+	if t.ResumableUploadDir != "" {
+		return t.ResumableUploadDir
+	}
+
+	return filepath.Join(os.TempDir(), "webtoolkit-uploads")
+}
+
+// resumableUploadTTL returns how long an inactive resumable upload created by t is kept
+func (t *Tools) resumableUploadTTL() time.Duration {
+	if t.ResumableUploadTTL > 0 {
+		return t.ResumableUploadTTL
+	}
+
+	return 24 * time.Hour
+}
+
+// saveResumableUpload writes the metadata of the upload id
+func (t *Tools) saveResumableUpload(id string, info resumableUploadInfo) error {
+	raw, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(t.resumableUploadDir(), id+".json"), raw, 0644)
+}
+
+// loadResumableUpload reads the metadata of the upload id, deleting the upload instead if it has expired.
+// ErrUploadNotFound is returned for IDs that were not issued by CreateUpload, which also keeps an ID from
+// naming a file outside ResumableUploadDir
+func (t *Tools) loadResumableUpload(id string) (resumableUploadInfo, error) {
+	var info resumableUploadInfo
+
+	if raw, err := base64.RawURLEncoding.DecodeString(id); err != nil || len(raw) != 16 {
+		forgetResumableUpload(id)
+		return info, ErrUploadNotFound
+	}
+
+	raw, err := os.ReadFile(filepath.Join(t.resumableUploadDir(), id+".json"))
+	if errors.Is(err, fs.ErrNotExist) {
+		forgetResumableUpload(id)
+		return info, ErrUploadNotFound
+	}
+	if err != nil {
+		return info, err
+	}
+
+	err = json.Unmarshal(raw, &info)
+	if err != nil {
+		return info, err
+	}
+
+	// uploads are expired by the TTL they were created with, so that Tools sharing the metadata directory with
+	// a different TTL never cut short one another's uploads
+	ttl := info.TTL
+	if ttl <= 0 {
+		ttl = t.resumableUploadTTL()
+	}
+
+	// the partial file is modified by every chunk, so its age is the time since the upload was last active
+	lastActive := info.CreatedAt
+	if stat, err := os.Stat(filepath.Join(info.Dir, id+".part")); err == nil {
+		lastActive = stat.ModTime()
+	}
+
+	if time.Since(lastActive) > ttl {
+		t.removeResumableUpload(id, info)
+		return info, ErrUploadNotFound
+	}
+
+	return info, nil
+}
+
+// expireResumableUploads deletes the uploads in metadataDir that have been inactive for longer than the
+// ResumableUploadTTL they were created with
+func (t *Tools) expireResumableUploads(metadataDir string) {
+	entries, err := os.ReadDir(metadataDir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if entry.IsDir() || id == entry.Name() {
+			continue
+		}
+
+		unlock := lockResumableUpload(id)
+		_, _ = t.loadResumableUpload(id)
+		unlock()
+	}
+}
+
+// removeResumableUpload deletes the partial file and metadata of the upload id. The caller holds its lock
+func (t *Tools) removeResumableUpload(id string, info resumableUploadInfo) {
+	_ = os.Remove(filepath.Join(info.Dir, id+".part"))
+	_ = os.Remove(filepath.Join(t.resumableUploadDir(), id+".json"))
+
+	forgetResumableUpload(id)
+}
+
+// forgetResumableUpload drops the lock of the upload id, which no longer exists. Anyone still waiting on the
+// lock finds the upload gone once they hold it
+func forgetResumableUpload(id string) {
+	resumableUploadLocks.Lock()
+	delete(resumableUploadLocks.locks, id)
+	resumableUploadLocks.Unlock()
+}
+
+// fileSize returns the size of the file called name
+func fileSize(name string) (int64, error) {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return 0, err
+	}
+
+	return stat.Size(), nil
 }
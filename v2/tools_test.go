@@ -2,18 +2,36 @@ package webtoolkit
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
 	"image"
 	"image/png"
 	"io"
+	"io/fs"
+	"math"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 type RoundTripFunc func(req *http.Request) *http.Response
@@ -28,6 +46,45 @@ func MockTestClient(fn RoundTripFunc) *http.Client {
 	}
 }
 
+// testUpload describes a single file part to include in a multipart test request
+type testUpload struct {
+	field    string
+	filename string
+	content  []byte
+}
+
+// newUploadRequest builds a multipart POST request containing the supplied form values and files
+func newUploadRequest(t testing.TB, uploads []testUpload, values map[string]string) *http.Request {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	for key, value := range values {
+		if err := writer.WriteField(key, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, upload := range uploads {
+		part, err := writer.CreateFormFile(upload.field, upload.filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = part.Write(upload.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", writer.FormDataContentType())
+
+	return request
+}
+
 func TestTools_RandomString(t *testing.T) {
 	var testTools Tools
 	const testLen = 10
@@ -39,6 +96,165 @@ func TestTools_RandomString(t *testing.T) {
 	}
 }
 
+var randomStringWithCharsetTests = []struct {
+	name    string
+	preset  CharsetPreset
+	pattern string
+}{
+	{name: "numeric", preset: CharsetNumeric, pattern: `^[0-9]+$`},
+	{name: "lower alpha", preset: CharsetLowerAlpha, pattern: `^[a-z]+$`},
+	{name: "alphanumeric", preset: CharsetAlphaNumeric, pattern: `^[a-zA-Z0-9]+$`},
+	{name: "unambiguous", preset: CharsetUnambiguous, pattern: `^[^0O1lI]+$`},
+}
+
+func TestTools_RandomStringWithCharset(t *testing.T) {
+	var testTools Tools
+	const testLen = 200
+
+	for _, entry := range randomStringWithCharsetTests {
+		s, err := testTools.RandomStringWithCharset(testLen, entry.preset)
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		if len(s) != testLen {
+			t.Errorf("%s: length set to %d, expected %d", entry.name, len(s), testLen)
+		}
+
+		if !regexp.MustCompile(entry.pattern).MatchString(s) {
+			t.Errorf("%s: %s contains characters outside the preset", entry.name, s)
+		}
+
+		for _, c := range s {
+			if !strings.ContainsRune(string(entry.preset), c) {
+				t.Errorf("%s: unexpected character %q", entry.name, c)
+			}
+		}
+	}
+
+	if _, err := testTools.RandomStringWithCharset(testLen, ""); !errors.Is(err, ErrEmptyCharset) {
+		t.Errorf("empty charset: expected ErrEmptyCharset, got %v", err)
+	}
+}
+
+func TestTools_RandomBytes(t *testing.T) {
+	var testTools Tools
+	const testLen = 16
+
+	first, err := testTools.RandomBytes(testLen)
+	if err != nil {
+		t.Error(err)
+	}
+
+	second, err := testTools.RandomBytes(testLen)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if len(first) != testLen || len(second) != testLen {
+		t.Error("wrong number of random bytes returned")
+	}
+
+	if bytes.Equal(first, second) {
+		t.Error("successive calls returned identical bytes")
+	}
+
+	testTools.RandReader = bytes.NewReader([]byte("short"))
+	_, err = testTools.RandomBytes(testLen)
+	if err == nil {
+		t.Error("expected error from exhausted random source but none received")
+	}
+}
+
+func TestTools_RandomHex(t *testing.T) {
+	var testTools Tools
+	const testLen = 16
+
+	first, err := testTools.RandomHex(testLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := testTools.RandomHex(testLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(first) != testLen*2 {
+		t.Errorf("random hex string has length %d, expected %d", len(first), testLen*2)
+	}
+
+	if _, err := hex.DecodeString(first); err != nil {
+		t.Errorf("random hex string is not valid hex: %v", err)
+	}
+
+	if first == second {
+		t.Error("successive calls returned identical strings")
+	}
+
+	testTools.RandReader = bytes.NewReader([]byte("short"))
+	if _, err = testTools.RandomHex(testLen); err == nil {
+		t.Error("expected error from exhausted random source but none received")
+	}
+}
+
+func TestTools_RandomURLSafe(t *testing.T) {
+	var testTools Tools
+	const testLen = 16
+
+	first, err := testTools.RandomURLSafe(testLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := testTools.RandomURLSafe(testLen)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(first)
+	if err != nil {
+		t.Errorf("random string is not URL safe base64: %v", err)
+	}
+
+	if len(decoded) != testLen {
+		t.Errorf("random string decodes to %d bytes, expected %d", len(decoded), testLen)
+	}
+
+	if first == second {
+		t.Error("successive calls returned identical strings")
+	}
+
+	testTools.RandReader = bytes.NewReader([]byte("short"))
+	if _, err = testTools.RandomURLSafe(testLen); err == nil {
+		t.Error("expected error from exhausted random source but none received")
+	}
+}
+
+func TestTools_GenerateToken(t *testing.T) {
+	var testTools Tools
+
+	for _, byteLen := range []int{1, 16, 32, 33} {
+		token, err := testTools.GenerateToken(byteLen)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if strings.ContainsAny(token, "+/=") {
+			t.Errorf("token %s contains characters that are not URL safe", token)
+		}
+
+		decoded, err := base64.RawURLEncoding.DecodeString(token)
+		if err != nil {
+			t.Errorf("token %s is not URL safe base64: %v", token, err)
+		}
+
+		if len(decoded) != byteLen {
+			t.Errorf("token decodes to %d bytes, expected %d", len(decoded), byteLen)
+		}
+	}
+}
+
 var uploadTests = []struct {
 	name          string
 	allowedTypes  []string
@@ -177,6 +393,35 @@ func TestTools_CreateDirIfNotExists(t *testing.T) {
 	_ = os.Remove(target)
 }
 
+func TestTools_CreateDirIfNotExistsPermissions(t *testing.T) {
+	var testTools Tools
+	target := filepath.Join(t.TempDir(), "private")
+
+	err := testTools.CreateDirIfNotExists(target, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0700 {
+		t.Errorf("directory mode set to %o, expected 700", info.Mode().Perm())
+	}
+
+	file := filepath.Join(t.TempDir(), "regular-file")
+	if err = os.WriteFile(file, []byte("not a directory"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	err = testTools.CreateDirIfNotExists(file)
+	if err == nil {
+		t.Error("expected error for an existing regular file but none received")
+	}
+}
+
 var slugTests = []struct {
 	name          string
 	s             string
@@ -206,6 +451,43 @@ func TestTools_Slugify(t *testing.T) {
 	}
 }
 
+func TestTools_SlugifyUniqueFunc(t *testing.T) {
+	var testTools Tools
+
+	taken := map[string]bool{"hello-world": true, "hello-world-1": true}
+	var checked []string
+	exists := func(candidate string) (bool, error) {
+		checked = append(checked, candidate)
+		return taken[candidate], nil
+	}
+
+	slug, err := testTools.SlugifyUniqueFunc("Hello, World", exists)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if slug != "hello-world-2" {
+		t.Errorf("got slug %s, expected hello-world-2", slug)
+	}
+
+	if len(checked) != 3 {
+		t.Errorf("expected 3 candidates to be checked, got %d", len(checked))
+	}
+
+	checkErr := errors.New("database unavailable")
+	_, err = testTools.SlugifyUniqueFunc("Hello, World", func(candidate string) (bool, error) {
+		return false, checkErr
+	})
+	if !errors.Is(err, checkErr) {
+		t.Errorf("expected check error to be propagated, got %v", err)
+	}
+
+	_, err = testTools.SlugifyUniqueFunc("", exists)
+	if err == nil {
+		t.Error("expected error for empty string but none received")
+	}
+}
+
 func TestTools_DownloadStaticFile(t *testing.T) {
 	rr := httptest.NewRecorder()
 	req, _ := http.NewRequest("GET", "/", nil)
@@ -238,6 +520,61 @@ func TestTools_DownloadStaticFile(t *testing.T) {
 	}
 }
 
+func TestTools_DownloadBytes(t *testing.T) {
+	rr := httptest.NewRecorder()
+
+	var testTools Tools
+
+	report := []byte("id,name\n1,widget\n")
+	testTools.DownloadBytes(rr, report, "text/csv", "report.csv")
+
+	if rr.Body.String() != string(report) {
+		t.Errorf("Incorrect body: got %q, expected %q", rr.Body.String(), report)
+	}
+
+	expectedHeaders := map[string]string{
+		"Content-Type":        "text/csv",
+		"Content-Length":      strconv.Itoa(len(report)),
+		"Content-Disposition": `attachment; filename="report.csv"`,
+	}
+
+	for key, expected := range expectedHeaders {
+		if actual := rr.Header().Get(key); actual != expected {
+			t.Errorf("Incorrect %s: got %s, expected %s", key, actual, expected)
+		}
+	}
+
+	rr = httptest.NewRecorder()
+	testTools.DownloadBytes(rr, report, "", "report.bin")
+
+	if rr.Header().Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Incorrect content type: got %s, expected application/octet-stream", rr.Header().Get("Content-Type"))
+	}
+}
+
+func TestTools_DownloadStaticFileContentType(t *testing.T) {
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	var testTools Tools
+
+	testTools.DownloadStaticFile(rr, req, "./testdata/tipfinger.jpg", "report.bin", "application/octet-stream")
+
+	res := rr.Result()
+	defer res.Body.Close()
+
+	if res.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Incorrect content type: got %s, expected application/octet-stream", res.Header.Get("Content-Type"))
+	}
+
+	rr = httptest.NewRecorder()
+	testTools.DownloadStaticFile(rr, req, "./testdata/tipfinger.jpg", "loljohnny.jpg")
+
+	if rr.Header().Get("Content-Type") != "image/jpeg" {
+		t.Errorf("Incorrect content type: got %s, expected image/jpeg", rr.Header().Get("Content-Type"))
+	}
+}
+
 var jsonReadTests = []struct {
 	name               string
 	json               string
@@ -246,6 +583,7 @@ var jsonReadTests = []struct {
 	allowUnknownFields bool
 }{
 	{name: "good json", json: `{"foo": "bar"}`, errorExpected: false, maxSize: 512, allowUnknownFields: false},
+	{name: "good json with BOM", json: "\ufeff" + `{"foo": "bar"}`, errorExpected: false, maxSize: 512, allowUnknownFields: false},
 	{name: "malformed JSON", json: `{"foo": "bar"`, errorExpected: true, maxSize: 512, allowUnknownFields: false},
 	{name: "not JSON", json: "Yo bar to the foo", errorExpected: true, maxSize: 512, allowUnknownFields: false},
 	{name: "invalid type", json: `{"foo": 1}`, errorExpected: true, maxSize: 512, allowUnknownFields: false},
@@ -292,6 +630,51 @@ func TestTools_ReadJSON(t *testing.T) {
 	}
 }
 
+var jsonArrayReadTests = []struct {
+	name          string
+	json          string
+	length        int
+	errorExpected bool
+}{
+	{name: "array", json: `[{"foo": "bar"}, {"foo": "baz"}]`, length: 2},
+	{name: "empty array", json: `[]`, length: 0},
+	{name: "trailing whitespace", json: "[{\"foo\": \"bar\"}]\n", length: 1},
+	{name: "array then object", json: `[{"foo": "bar"}]{"foo": "baz"}`, errorExpected: true},
+	{name: "array then array", json: `[{"foo": "bar"}][{"foo": "baz"}]`, errorExpected: true},
+	{name: "array then unknown field", json: `[{"foo": "bar"}]{"baz": 1}`, errorExpected: true},
+	{name: "array then garbage", json: `[{"foo": "bar"}]]`, errorExpected: true},
+}
+
+func TestTools_ReadJSONArray(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range jsonArrayReadTests {
+		var decodedJSON []struct {
+			Foo string `json:"foo"`
+		}
+
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(entry.json))
+		rr := httptest.NewRecorder()
+
+		err := testTools.ReadJSON(rr, req, &decodedJSON)
+
+		if entry.errorExpected {
+			if !errors.Is(err, ErrMultiplePayloads) {
+				t.Errorf("%s: expected ErrMultiplePayloads, got %v", entry.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		if len(decodedJSON) != entry.length {
+			t.Errorf("%s: decoded %d elements, expected %d", entry.name, len(decodedJSON), entry.length)
+		}
+	}
+}
+
 func TestTools_WriteJSON(t *testing.T) {
 	var testTools Tools
 
@@ -341,6 +724,41 @@ func TestTools_ErrorJSON(t *testing.T) {
 	}
 }
 
+func TestTools_ErrorJSONWithCode(t *testing.T) {
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	errorText := "name is required"
+	errorCode := "VALIDATION_FAILED"
+	err := testTools.ErrorJSONWithCode(rr, errors.New(errorText), errorCode, http.StatusUnprocessableEntity)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var payload JSONResponse
+	decoder := json.NewDecoder(rr.Body)
+	err = decoder.Decode(&payload)
+	if err != nil {
+		t.Error("error decoding JSON", err)
+	}
+
+	if !payload.Error {
+		t.Error("error set to `false` but should be `true`")
+	}
+
+	if payload.Message != errorText {
+		t.Errorf("error Message set to %s, expected %s", payload.Message, errorText)
+	}
+
+	if payload.Code != errorCode {
+		t.Errorf("error Code set to %s, expected %s", payload.Code, errorCode)
+	}
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("request status set to %d, expected %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
 func TestTools_PushJSONToRemote(t *testing.T) {
 	client := MockTestClient(func(req *http.Request) *http.Response {
 		// test request parameters
@@ -363,3 +781,4875 @@ func TestTools_PushJSONToRemote(t *testing.T) {
 		t.Error("failed to call remote url:", err)
 	}
 }
+
+func TestTools_JSONDiff(t *testing.T) {
+	var testTools Tools
+
+	old := []byte(`{"name": "alice", "age": 30, "email": "a@example.com", "address": {"city": "Paris", "zip": "75001"}}`)
+	updated := []byte(`{"name": "alice", "age": 31, "phone": "555-1234", "address": {"city": "Lyon", "zip": "75001", "country": "FR"}}`)
+
+	diff, err := testTools.JSONDiff(old, updated)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	added := diff["added"].(map[string]interface{})
+	removed := diff["removed"].(map[string]interface{})
+	changed := diff["changed"].(map[string]interface{})
+
+	if added["phone"] != "555-1234" {
+		t.Errorf("expected phone to be added, got %v", added["phone"])
+	}
+
+	if added["address.country"] != "FR" {
+		t.Errorf("expected nested address.country to be added, got %v", added["address.country"])
+	}
+
+	if removed["email"] != "a@example.com" {
+		t.Errorf("expected email to be removed, got %v", removed["email"])
+	}
+
+	age, ok := changed["age"].(map[string]interface{})
+	if !ok || age["old"] != float64(30) || age["new"] != float64(31) {
+		t.Errorf("expected age to change from 30 to 31, got %v", changed["age"])
+	}
+
+	city, ok := changed["address.city"].(map[string]interface{})
+	if !ok || city["old"] != "Paris" || city["new"] != "Lyon" {
+		t.Errorf("expected address.city to change from Paris to Lyon, got %v", changed["address.city"])
+	}
+
+	if _, ok := changed["name"]; ok {
+		t.Error("unchanged key name reported as changed")
+	}
+
+	if _, ok := changed["address.zip"]; ok {
+		t.Error("unchanged key address.zip reported as changed")
+	}
+
+	_, err = testTools.JSONDiff([]byte(`{"foo": "bar"`), updated)
+	if err == nil {
+		t.Error("expected error for malformed JSON but none received")
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	var testTools Tools
+	for _, entry := range jsonReadTests {
+		testTools.MaxJSONSize = entry.maxSize
+		testTools.AllowUnknownFields = entry.allowUnknownFields
+
+		var fromReader, fromRequest struct {
+			Foo string `json:"foo"`
+		}
+
+		readerErr := DecodeJSON(bytes.NewReader([]byte(entry.json)), &fromReader, entry.maxSize, entry.allowUnknownFields)
+
+		// like a plain reader, the request has no Content-Length, so neither error knows the size of the body
+		req, err := http.NewRequest("POST", "/", bytes.NewReader([]byte(entry.json)))
+		if err != nil {
+			t.Log("Error:", err)
+		}
+		req.ContentLength = -1
+		rr := httptest.NewRecorder()
+
+		requestErr := testTools.ReadJSON(rr, req, &fromRequest)
+
+		if entry.errorExpected && readerErr == nil {
+			t.Errorf("%s: error expected, but none received", entry.name)
+		}
+
+		if !entry.errorExpected && readerErr != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, readerErr.Error())
+		}
+
+		if fmt.Sprint(readerErr) != fmt.Sprint(requestErr) {
+			t.Errorf("%s: reader error %q does not match request error %q", entry.name, readerErr, requestErr)
+		}
+
+		if fromReader != fromRequest {
+			t.Errorf("%s: decoded values differ: %v and %v", entry.name, fromReader, fromRequest)
+		}
+
+		req.Body.Close()
+	}
+}
+
+func TestTools_WriteJSONBeforeDeadline(t *testing.T) {
+	var testTools Tools
+
+	// slow producer: one result is ready immediately, the rest arrive well after the deadline
+	slow := make(chan interface{}, 3)
+	go func() {
+		slow <- "first"
+		time.Sleep(200 * time.Millisecond)
+		slow <- "second"
+		slow <- "third"
+		close(slow)
+	}()
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSONBeforeDeadline(rr, http.StatusOK, time.Now().Add(50*time.Millisecond), slow)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var payload PartialJSONResponse
+	err = json.NewDecoder(rr.Body).Decode(&payload)
+	if err != nil {
+		t.Error("error decoding JSON", err)
+	}
+
+	if !payload.Partial {
+		t.Error("partial set to `false` but should be `true`")
+	}
+
+	if len(payload.Data) != 1 || payload.Data[0] != "first" {
+		t.Errorf("expected only the first result, got %v", payload.Data)
+	}
+
+	// fast producer: everything is ready before the deadline
+	fast := make(chan interface{}, 2)
+	fast <- "first"
+	fast <- "second"
+	close(fast)
+
+	rr = httptest.NewRecorder()
+	err = testTools.WriteJSONBeforeDeadline(rr, http.StatusOK, time.Now().Add(time.Second), fast)
+	if err != nil {
+		t.Error(err)
+	}
+
+	payload = PartialJSONResponse{}
+	err = json.NewDecoder(rr.Body).Decode(&payload)
+	if err != nil {
+		t.Error("error decoding JSON", err)
+	}
+
+	if payload.Partial {
+		t.Error("partial set to `true` but should be `false`")
+	}
+
+	if len(payload.Data) != 2 {
+		t.Errorf("expected 2 results, got %d", len(payload.Data))
+	}
+
+	// unbuffered producer: it must be able to finish sending after the deadline has passed
+	unbuffered := make(chan interface{})
+	producerDone := make(chan struct{})
+	go func() {
+		defer close(producerDone)
+		unbuffered <- "first"
+		time.Sleep(100 * time.Millisecond)
+		unbuffered <- "second"
+		unbuffered <- "third"
+		close(unbuffered)
+	}()
+
+	rr = httptest.NewRecorder()
+	err = testTools.WriteJSONBeforeDeadline(rr, http.StatusOK, time.Now().Add(50*time.Millisecond), unbuffered)
+	if err != nil {
+		t.Error(err)
+	}
+
+	select {
+	case <-producerDone:
+	case <-time.After(time.Second):
+		t.Error("unbuffered producer is still blocked after the deadline")
+	}
+}
+
+var jsonErrorTests = []struct {
+	name     string
+	json     string
+	maxSize  int
+	expected error
+}{
+	{name: "malformed JSON", json: `{"foo": "bar"`, maxSize: 512, expected: ErrBadlyFormedJSON},
+	{name: "not JSON", json: "Yo bar to the foo", maxSize: 512, expected: ErrBadlyFormedJSON},
+	{name: "invalid type", json: `{"foo": 1}`, maxSize: 512, expected: ErrIncorrectJSONType},
+	{name: "unknown field", json: `{"foo": "bar", "baz": "fippity"}`, maxSize: 512, expected: ErrUnknownField},
+	{name: "payload too large", json: `{"foo": "bar"}`, maxSize: 5, expected: ErrBodyTooLarge},
+	{name: "empty payload", json: "", maxSize: 512, expected: ErrEmptyBody},
+	{name: "multiple payloads", json: `{"foo": "bar"}{"foo": "baz"}`, maxSize: 512, expected: ErrMultiplePayloads},
+}
+
+func TestTools_ReadJSONErrors(t *testing.T) {
+	var testTools Tools
+	for _, entry := range jsonErrorTests {
+		testTools.MaxJSONSize = entry.maxSize
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req, err := http.NewRequest("POST", "/", bytes.NewReader([]byte(entry.json)))
+		if err != nil {
+			t.Log("Error:", err)
+		}
+		rr := httptest.NewRecorder()
+
+		err = testTools.ReadJSON(rr, req, &decodedJSON)
+		if !errors.Is(err, entry.expected) {
+			t.Errorf("%s: expected error matching %q, got %v", entry.name, entry.expected, err)
+		}
+
+		req.Body.Close()
+	}
+
+	req, _ := http.NewRequest("POST", "/", bytes.NewReader([]byte(`{"foo": "bar", "baz": "fippity"}`)))
+	rr := httptest.NewRecorder()
+	testTools.MaxJSONSize = 512
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	err := testTools.ReadJSON(rr, req, &decodedJSON)
+
+	var unknownFieldError *UnknownFieldError
+	if !errors.As(err, &unknownFieldError) {
+		t.Fatalf("expected an UnknownFieldError, got %v", err)
+	}
+
+	if unknownFieldError.Field != "baz" {
+		t.Errorf("unknown field set to %s, expected baz", unknownFieldError.Field)
+	}
+
+	if err.Error() != `body contains unknown key "baz"` {
+		t.Errorf("unexpected error message: %s", err.Error())
+	}
+}
+
+func TestTools_UploadFilesFullyDecodeImages(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.FullyDecodeImages = true
+
+	uploadDir := t.TempDir()
+
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "valid.png", content: img}}, nil)
+	files, err := testTools.UploadFiles(request, uploadDir)
+	if err != nil {
+		t.Errorf("valid image rejected: %s", err.Error())
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected 1 uploaded file, got %d", len(files))
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, files[0].NewFileName)); os.IsNotExist(err) {
+		t.Errorf("expected file to exist: %s", err.Error())
+	}
+
+	request = newUploadRequest(t, []testUpload{{field: "file", filename: "truncated.png", content: img[:len(img)/2]}}, nil)
+	_, err = testTools.UploadFiles(request, uploadDir, false)
+	if err == nil {
+		t.Error("truncated image accepted, but an error was expected")
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "truncated.png")); !os.IsNotExist(err) {
+		t.Error("truncated image should not have been written to disk")
+	}
+}
+
+func TestTools_PushJSONToRemoteTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var testTools Tools
+	testTools.RemoteTimeout = 50 * time.Millisecond
+
+	_, _, err := testTools.PushJSONToRemote(server.URL, map[string]string{"bar": "baz"})
+	if err == nil {
+		t.Fatal("expected a timeout error but none received")
+	}
+
+	if !os.IsTimeout(err) {
+		t.Errorf("expected a timeout error, got %v", err)
+	}
+
+	testTools.RemoteTimeout = 0
+
+	_, status, err := testTools.PushJSONToRemote(server.URL, map[string]string{"bar": "baz"})
+	if err != nil {
+		t.Errorf("unexpected error without a timeout: %v", err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf("status set to %d, expected %d", status, http.StatusOK)
+	}
+}
+
+func TestReadJSONInto(t *testing.T) {
+	var testTools Tools
+	for _, entry := range jsonReadTests {
+		testTools.MaxJSONSize = entry.maxSize
+		testTools.AllowUnknownFields = entry.allowUnknownFields
+
+		type testPayload struct {
+			Foo string `json:"foo"`
+		}
+
+		req, _ := http.NewRequest("POST", "/", bytes.NewReader([]byte(entry.json)))
+		rr := httptest.NewRecorder()
+
+		decodedJSON, err := ReadJSONInto[testPayload](rr, req, &testTools)
+
+		var expected testPayload
+		req, _ = http.NewRequest("POST", "/", bytes.NewReader([]byte(entry.json)))
+		expectedErr := testTools.ReadJSON(httptest.NewRecorder(), req, &expected)
+
+		if fmt.Sprint(err) != fmt.Sprint(expectedErr) {
+			t.Errorf("%s: error %q does not match ReadJSON error %q", entry.name, err, expectedErr)
+		}
+
+		if !entry.errorExpected && decodedJSON.Foo != "bar" {
+			t.Errorf("%s: decoded foo set to %s, expected bar", entry.name, decodedJSON.Foo)
+		}
+	}
+}
+
+func TestJSONHandler(t *testing.T) {
+	var testTools Tools
+
+	type greetRequest struct {
+		Name string `json:"name"`
+	}
+
+	type greetResponse struct {
+		Greeting string `json:"greeting"`
+	}
+
+	handler := JSONHandler(func(ctx context.Context, req greetRequest) (greetResponse, int, error) {
+		if req.Name == "" {
+			return greetResponse{}, http.StatusUnprocessableEntity, errors.New("name is required")
+		}
+
+		return greetResponse{Greeting: "hello " + req.Name}, http.StatusCreated, nil
+	}, &testTools)
+
+	var handlerTests = []struct {
+		name           string
+		json           string
+		expectedStatus int
+		errorExpected  bool
+		expectedText   string
+	}{
+		{name: "success", json: `{"name": "bob"}`, expectedStatus: http.StatusCreated, errorExpected: false, expectedText: "hello bob"},
+		{name: "decode error", json: `{"name": "bob"`, expectedStatus: http.StatusBadRequest, errorExpected: true, expectedText: "body contains badly formed JSON (unexpected EOF)"},
+		{name: "handler error", json: `{"name": ""}`, expectedStatus: http.StatusUnprocessableEntity, errorExpected: true, expectedText: "name is required"},
+	}
+
+	for _, entry := range handlerTests {
+		req, _ := http.NewRequest("POST", "/", bytes.NewReader([]byte(entry.json)))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != entry.expectedStatus {
+			t.Errorf("%s: status set to %d, expected %d", entry.name, rr.Code, entry.expectedStatus)
+		}
+
+		if entry.errorExpected {
+			var payload JSONResponse
+			if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+				t.Errorf("%s: error decoding JSON: %v", entry.name, err)
+			}
+
+			if !payload.Error || payload.Message != entry.expectedText {
+				t.Errorf("%s: unexpected error payload %+v", entry.name, payload)
+			}
+		} else {
+			var payload greetResponse
+			if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+				t.Errorf("%s: error decoding JSON: %v", entry.name, err)
+			}
+
+			if payload.Greeting != entry.expectedText {
+				t.Errorf("%s: greeting set to %s, expected %s", entry.name, payload.Greeting, entry.expectedText)
+			}
+		}
+	}
+}
+
+var languageTests = []struct {
+	name     string
+	sample   string
+	expected string
+}{
+	{name: "english", sample: "The quick brown fox jumps over the lazy dog and runs into the forest.", expected: "en"},
+	{name: "spanish", sample: "El perro de mi vecino es muy grande y come con los gatos.", expected: "es"},
+	{name: "russian", sample: "Съешь же ещё этих мягких французских булок, да выпей чаю.", expected: "ru"},
+	{name: "japanese", sample: "こんにちは、今日はいい天気ですね。", expected: "ja"},
+	{name: "chinese", sample: "我们今天去公园散步。", expected: "zh"},
+	{name: "korean", sample: "안녕하세요, 만나서 반갑습니다.", expected: "ko"},
+	{name: "no letters", sample: "12345 !!! ???", expected: "unknown"},
+	{name: "empty", sample: "", expected: "unknown"},
+}
+
+func TestTools_DetectLanguage(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range languageTests {
+		lang := testTools.DetectLanguage([]byte(entry.sample))
+		if lang != entry.expected {
+			t.Errorf("%s: detected %s, expected %s", entry.name, lang, entry.expected)
+		}
+	}
+}
+
+var apiVersionTests = []struct {
+	name          string
+	version       string
+	errorExpected bool
+}{
+	{name: "supported", version: "2", errorExpected: false},
+	{name: "also supported", version: "1", errorExpected: false},
+	{name: "unsupported", version: "3", errorExpected: true},
+	{name: "missing", version: "", errorExpected: true},
+}
+
+func TestTools_RequireAPIVersion(t *testing.T) {
+	var testTools Tools
+
+	var negotiated string
+	handler := testTools.RequireAPIVersion("1", "2")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		negotiated = APIVersionFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, entry := range apiVersionTests {
+		negotiated = ""
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		if entry.version != "" {
+			req.Header.Set("X-API-Version", entry.version)
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if entry.errorExpected {
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("%s: status set to %d, expected %d", entry.name, rr.Code, http.StatusBadRequest)
+			}
+
+			var payload JSONResponse
+			if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil || !payload.Error {
+				t.Errorf("%s: expected a JSON error response", entry.name)
+			}
+
+			if negotiated != "" {
+				t.Errorf("%s: handler should not have been called", entry.name)
+			}
+		} else {
+			if rr.Code != http.StatusOK {
+				t.Errorf("%s: status set to %d, expected %d", entry.name, rr.Code, http.StatusOK)
+			}
+
+			if negotiated != entry.version {
+				t.Errorf("%s: negotiated version set to %s, expected %s", entry.name, negotiated, entry.version)
+			}
+		}
+	}
+}
+
+func TestTools_UploadFilesSmallFile(t *testing.T) {
+	var testTools Tools
+	uploadDir := t.TempDir()
+	content := []byte("tiny file\n")
+
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "tiny.txt", content: content}}, nil)
+	files, err := testTools.UploadFiles(request, uploadDir, false)
+	if err != nil {
+		t.Fatalf("small file rejected: %s", err.Error())
+	}
+
+	stored, err := os.ReadFile(filepath.Join(uploadDir, "tiny.txt"))
+	if err != nil {
+		t.Fatalf("expected file to exist: %s", err.Error())
+	}
+
+	if !bytes.Equal(stored, content) {
+		t.Errorf("stored content %q does not match uploaded content %q", stored, content)
+	}
+
+	if files[0].FileSize != int64(len(content)) {
+		t.Errorf("file size set to %d, expected %d", files[0].FileSize, len(content))
+	}
+}
+
+func TestTools_WriteData(t *testing.T) {
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	err := testTools.WriteData(rr, http.StatusOK, "token", "abc123")
+	if err != nil {
+		t.Errorf("failed to write JSON: %v", err)
+	}
+
+	if rr.Body.String() != `{"token":"abc123"}` {
+		t.Errorf("unexpected JSON written: %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+
+	err = testTools.WriteJSON(rr, http.StatusOK, Envelope{"count": 2, "items": []string{"a", "b"}})
+	if err != nil {
+		t.Errorf("failed to write JSON: %v", err)
+	}
+
+	var payload map[string]interface{}
+	if err = json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Error("error decoding JSON", err)
+	}
+
+	if payload["count"] != float64(2) || len(payload["items"].([]interface{})) != 2 {
+		t.Errorf("unexpected envelope contents: %v", payload)
+	}
+}
+
+func TestTools_WriteManifestJSON(t *testing.T) {
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	parts := []ManifestPart{
+		{URL: "https://example.net/export/part-1", Size: 1024, Checksum: "sha256:aaaa"},
+		{URL: "https://example.net/export/part-2", Size: 512, Checksum: "sha256:bbbb"},
+	}
+
+	secret := "manifest-secret"
+
+	err := testTools.WriteManifestJSON(rr, parts, secret)
+	if err != nil {
+		t.Errorf("failed to write JSON: %v", err)
+	}
+
+	var manifest Manifest
+	if err = json.NewDecoder(rr.Body).Decode(&manifest); err != nil {
+		t.Error("error decoding JSON", err)
+	}
+
+	if len(manifest.Parts) != len(parts) {
+		t.Fatalf("manifest has %d parts, expected %d", len(manifest.Parts), len(parts))
+	}
+
+	for i, part := range manifest.Parts {
+		if part.Size != parts[i].Size || part.Checksum != parts[i].Checksum {
+			t.Errorf("part %d set to %+v, expected %+v", i, part, parts[i])
+		}
+
+		if !strings.HasPrefix(part.URL, parts[i].URL+"?signature=") {
+			t.Errorf("part %d: URL %s is not a signed form of %s", i, part.URL, parts[i].URL)
+		}
+
+		if !testTools.VerifyManifestURL(secret, part.URL) {
+			t.Errorf("part %d: URL %s does not verify", i, part.URL)
+		}
+
+		if testTools.VerifyManifestURL("other-secret", part.URL) {
+			t.Errorf("part %d: URL verified with the wrong secret", i)
+		}
+
+		if testTools.VerifyManifestURL(secret, strings.Replace(part.URL, "part-", "part-9", 1)) {
+			t.Errorf("part %d: tampered URL verified", i)
+		}
+	}
+
+	if testTools.VerifyManifestURL(secret, parts[0].URL) {
+		t.Error("unsigned URL verified")
+	}
+
+	// existing query parameters are covered by the signature, whatever their order
+	signed, err := testTools.signManifestURL(secret, "https://example.net/export/part-3?format=csv&gzip=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !testTools.VerifyManifestURL(secret, signed) || testTools.VerifyManifestURL(secret, strings.Replace(signed, "csv", "xml", 1)) {
+		t.Errorf("signature of %s does not cover its query", signed)
+	}
+
+	if manifest.TotalSize != 1536 {
+		t.Errorf("total size set to %d, expected 1536", manifest.TotalSize)
+	}
+
+	rr = httptest.NewRecorder()
+	_ = testTools.WriteManifestJSON(rr, nil, secret)
+
+	if rr.Body.String() != `{"parts":[],"total_size":0}` {
+		t.Errorf("unexpected JSON for empty manifest: %s", rr.Body.String())
+	}
+}
+
+func TestTools_SingleflightMiddleware(t *testing.T) {
+	var testTools Tools
+	var calls int32
+	release := make(chan struct{})
+
+	handler := testTools.SingleflightMiddleware(func(r *http.Request) string {
+		return r.URL.String()
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Header().Set("X-Computed", "yes")
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("expensive result"))
+	}))
+
+	const concurrentRequests = 10
+	recorders := make([]*httptest.ResponseRecorder, concurrentRequests)
+	wg := sync.WaitGroup{}
+
+	for i := 0; i < concurrentRequests; i++ {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+
+		go func(rr *httptest.ResponseRecorder) {
+			defer wg.Done()
+			req, _ := http.NewRequest("GET", "/report?year=2024", nil)
+			handler.ServeHTTP(rr, req)
+		}(recorders[i])
+	}
+
+	// give every request time to arrive before letting the handler finish
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if calls != 1 {
+		t.Errorf("handler ran %d times, expected 1", calls)
+	}
+
+	for i, rr := range recorders {
+		if rr.Code != http.StatusAccepted {
+			t.Errorf("request %d: status set to %d, expected %d", i, rr.Code, http.StatusAccepted)
+		}
+
+		if rr.Body.String() != "expensive result" {
+			t.Errorf("request %d: unexpected body %s", i, rr.Body.String())
+		}
+
+		if rr.Header().Get("X-Computed") != "yes" {
+			t.Errorf("request %d: expected buffered header to be replayed", i)
+		}
+	}
+
+	// once the first request has completed, a new one runs the handler again
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/report?year=2024", nil)
+	handler.ServeHTTP(rr, req)
+
+	if calls != 2 {
+		t.Errorf("handler ran %d times, expected 2", calls)
+	}
+}
+
+var negotiationTests = []struct {
+	name        string
+	accept      string
+	contentType string
+}{
+	{name: "missing accept", accept: "", contentType: "application/json"},
+	{name: "anything", accept: "*/*", contentType: "application/json"},
+	{name: "json", accept: "application/json", contentType: "application/json"},
+	{name: "xml", accept: "application/xml", contentType: "application/xml"},
+	{name: "text xml", accept: "text/xml", contentType: "application/xml"},
+	{name: "browser style", accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", contentType: "application/xml"},
+	{name: "json preferred by quality", accept: "application/xml;q=0.5, application/json", contentType: "application/json"},
+	{name: "unsupported", accept: "text/html", contentType: "application/json"},
+}
+
+func TestTools_WriteNegotiated(t *testing.T) {
+	var testTools Tools
+
+	type payload struct {
+		XMLName xml.Name `json:"-" xml:"item"`
+		Name    string   `json:"name" xml:"name"`
+	}
+
+	for _, entry := range negotiationTests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if entry.accept != "" {
+			req.Header.Set("Accept", entry.accept)
+		}
+		rr := httptest.NewRecorder()
+
+		err := testTools.WriteNegotiated(rr, req, http.StatusOK, payload{Name: "widget"})
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", entry.name, err)
+		}
+
+		if rr.Header().Get("Content-Type") != entry.contentType {
+			t.Errorf("%s: content type set to %s, expected %s", entry.name, rr.Header().Get("Content-Type"), entry.contentType)
+		}
+
+		var decoded payload
+		if entry.contentType == "application/xml" {
+			err = xml.NewDecoder(rr.Body).Decode(&decoded)
+		} else {
+			err = json.NewDecoder(rr.Body).Decode(&decoded)
+		}
+
+		if err != nil {
+			t.Errorf("%s: body does not match content type: %v", entry.name, err)
+		}
+
+		if decoded.Name != "widget" {
+			t.Errorf("%s: decoded name set to %s, expected widget", entry.name, decoded.Name)
+		}
+	}
+}
+
+func TestTools_PushJSONToRemoteWithReceipt(t *testing.T) {
+	responseBody := strings.Repeat("x", maxReceiptSnippet+100)
+	client := MockTestClient(func(req *http.Request) *http.Response {
+		time.Sleep(10 * time.Millisecond)
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString(responseBody)),
+			Header:     make(http.Header),
+		}
+	})
+
+	var testTool Tools
+	before := time.Now()
+
+	receipt, err := testTool.PushJSONToRemoteWithReceipt("http://example.net", map[string]string{"bar": "baz"}, client)
+	if err != nil {
+		t.Error("failed to call remote url:", err)
+	}
+
+	if receipt.StatusCode != http.StatusAccepted {
+		t.Errorf("status set to %d, expected %d", receipt.StatusCode, http.StatusAccepted)
+	}
+
+	if receipt.AttemptedAt.Before(before) || receipt.AttemptedAt.After(time.Now()) {
+		t.Errorf("unexpected attempt time %v", receipt.AttemptedAt)
+	}
+
+	if receipt.Latency < 10*time.Millisecond {
+		t.Errorf("latency set to %v, expected at least 10ms", receipt.Latency)
+	}
+
+	if len(receipt.ResponseSnippet) != maxReceiptSnippet {
+		t.Errorf("response snippet has length %d, expected %d", len(receipt.ResponseSnippet), maxReceiptSnippet)
+	}
+}
+
+func TestTools_UploadFilesAndFields(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	uploadDir := t.TempDir()
+
+	request := newUploadRequest(t,
+		[]testUpload{{field: "file", filename: "cyborg-ape.png", content: img}},
+		map[string]string{"caption": "a cyborg ape", "album": "42"},
+	)
+
+	files, fields, err := testTools.UploadFilesAndFields(request, uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected 1 uploaded file, got %d", len(files))
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, files[0].NewFileName)); os.IsNotExist(err) {
+		t.Errorf("expected file to exist: %s", err.Error())
+	}
+
+	if len(fields["caption"]) != 1 || fields["caption"][0] != "a cyborg ape" {
+		t.Errorf("caption set to %v, expected [a cyborg ape]", fields["caption"])
+	}
+
+	if len(fields["album"]) != 1 || fields["album"][0] != "42" {
+		t.Errorf("album set to %v, expected [42]", fields["album"])
+	}
+
+	// a form holding only fields still returns them, alongside ErrNoFiles
+	request = newUploadRequest(t, nil, map[string]string{"caption": "no file"})
+
+	files, fields, err = testTools.UploadFilesAndFields(request, uploadDir)
+	if !errors.Is(err, ErrNoFiles) {
+		t.Errorf("fields only: expected ErrNoFiles, got %v", err)
+	}
+
+	if len(files) != 0 || len(fields["caption"]) != 1 || fields["caption"][0] != "no file" {
+		t.Errorf("fields only: expected the caption and no files, got %v and %v", fields, files)
+	}
+
+	// so does a form whose file is rejected
+	testTools.AllowedFileTypes = []string{"image/jpeg"}
+	request = newUploadRequest(t,
+		[]testUpload{{field: "file", filename: "cyborg-ape.png", content: img}},
+		map[string]string{"caption": "rejected"},
+	)
+
+	_, fields, err = testTools.UploadFilesAndFields(request, uploadDir)
+	if err == nil {
+		t.Error("rejected file: error expected, but none received")
+	}
+
+	if len(fields["caption"]) != 1 || fields["caption"][0] != "rejected" {
+		t.Errorf("rejected file: caption set to %v, expected [rejected]", fields["caption"])
+	}
+}
+
+func TestTools_GetJSONFromRemote(t *testing.T) {
+	var method string
+	status, body := http.StatusOK, `{"bar": "baz"}`
+
+	client := MockTestClient(func(req *http.Request) *http.Response {
+		method = req.Method
+		return &http.Response{
+			StatusCode: status,
+			Body:       io.NopCloser(bytes.NewBufferString(body)),
+			Header:     make(http.Header),
+		}
+	})
+
+	var testTool Tools
+
+	var data struct {
+		Bar string `json:"bar"`
+	}
+
+	code, err := testTool.GetJSONFromRemote("http://example.net", &data, client)
+	if err != nil {
+		t.Error("failed to call remote url:", err)
+	}
+
+	if method != "GET" {
+		t.Errorf("request method set to %s, expected GET", method)
+	}
+
+	if code != http.StatusOK {
+		t.Errorf("status set to %d, expected %d", code, http.StatusOK)
+	}
+
+	if data.Bar != "baz" {
+		t.Errorf("decoded bar set to %s, expected baz", data.Bar)
+	}
+
+	body = `{"bar": "baz"`
+	_, err = testTool.GetJSONFromRemote("http://example.net", &data, client)
+	if !errors.Is(err, ErrBadlyFormedJSON) {
+		t.Errorf("expected badly formed JSON error, got %v", err)
+	}
+
+	status, body = http.StatusNotFound, `{"error": true}`
+	code, err = testTool.GetJSONFromRemote("http://example.net", &data, client)
+	if err == nil {
+		t.Error("expected error for non-2xx status but none received")
+	}
+
+	if code != http.StatusNotFound {
+		t.Errorf("status set to %d, expected %d", code, http.StatusNotFound)
+	}
+}
+
+func TestTools_UploadFilesConcurrentCollision(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadDir := t.TempDir()
+	const concurrentUploads = 8
+
+	requests := make([]*http.Request, concurrentUploads)
+	for i := range requests {
+		requests[i] = newUploadRequest(t, []testUpload{{field: "file", filename: "same-name.png", content: img}}, nil)
+	}
+
+	var succeeded, collided int32
+	wg := sync.WaitGroup{}
+
+	for _, request := range requests {
+		wg.Add(1)
+
+		go func(r *http.Request) {
+			defer wg.Done()
+
+			var testTools Tools
+			_, err := testTools.UploadFiles(r, uploadDir, false)
+
+			switch {
+			case err == nil:
+				atomic.AddInt32(&succeeded, 1)
+			case errors.Is(err, fs.ErrExist):
+				atomic.AddInt32(&collided, 1)
+			default:
+				t.Errorf("unexpected error: %v", err)
+			}
+		}(request)
+	}
+
+	wg.Wait()
+
+	if succeeded != 1 {
+		t.Errorf("%d uploads succeeded, expected exactly 1", succeeded)
+	}
+
+	if collided != concurrentUploads-1 {
+		t.Errorf("%d uploads collided, expected %d", collided, concurrentUploads-1)
+	}
+
+	stored, err := os.ReadFile(filepath.Join(uploadDir, "same-name.png"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(stored, img) {
+		t.Error("stored file does not match the uploaded content")
+	}
+}
+
+func TestTools_HandlePresignedUpload(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	secret := []byte("upload-secret")
+
+	createToken := func(maxSize int64, allowedTypes []string, ttl time.Duration, secret []byte) string {
+		token, err := testTools.CreateUploadToken(maxSize, allowedTypes, ttl, secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return token
+	}
+
+	if _, err := testTools.CreateUploadToken(0, nil, time.Minute, secret); err == nil {
+		t.Error("zero maximum size: error expected, but none received")
+	}
+
+	// a token signed with the right secret but without a maximum size, as CreateUploadToken refuses to make one
+	unlimitedClaims, _ := json.Marshal(uploadTokenClaims{Expires: time.Now().Add(time.Minute).Unix()})
+	unlimitedPayload := base64.RawURLEncoding.EncodeToString(unlimitedClaims)
+	unlimitedToken := unlimitedPayload + "." + signUploadToken(unlimitedPayload, secret)
+
+	var presignedTests = []struct {
+		name           string
+		token          string
+		allowedTypes   []string
+		maxFileSize    int
+		expectedStatus int
+	}{
+		{name: "valid token", token: createToken(int64(len(img)), []string{"image/png"}, time.Minute, secret), expectedStatus: http.StatusCreated},
+		{name: "expired token", token: createToken(int64(len(img)), []string{"image/png"}, -time.Minute, secret), expectedStatus: http.StatusForbidden},
+		{name: "wrong secret", token: createToken(int64(len(img)), []string{"image/png"}, time.Minute, []byte("other")), expectedStatus: http.StatusForbidden},
+		{name: "missing token", token: "", expectedStatus: http.StatusForbidden},
+		{name: "token without maximum size", token: unlimitedToken, expectedStatus: http.StatusForbidden},
+		{name: "type violation", token: createToken(int64(len(img)), []string{"image/jpeg"}, time.Minute, secret), expectedStatus: http.StatusBadRequest},
+		{name: "size violation", token: createToken(int64(len(img)-1), []string{"image/png"}, time.Minute, secret), expectedStatus: http.StatusBadRequest},
+		{name: "token narrows max file size", token: createToken(int64(len(img)-1), []string{"image/png"}, time.Minute, secret), maxFileSize: 2 * len(img), expectedStatus: http.StatusBadRequest},
+		{name: "token cannot raise max file size", token: createToken(2*int64(len(img)), []string{"image/png"}, time.Minute, secret), maxFileSize: len(img) - 1, expectedStatus: http.StatusBadRequest},
+		{name: "token within max file size", token: createToken(int64(len(img)), []string{"image/png"}, time.Minute, secret), maxFileSize: 2 * len(img), expectedStatus: http.StatusCreated},
+		{name: "token narrows allowed types", token: createToken(int64(len(img)), []string{"image/png"}, time.Minute, secret), allowedTypes: []string{"image/*"}, expectedStatus: http.StatusCreated},
+		{name: "token without types", token: createToken(int64(len(img)), nil, time.Minute, secret), allowedTypes: []string{"image/jpeg"}, expectedStatus: http.StatusBadRequest},
+		{name: "token cannot widen allowed types", token: createToken(int64(len(img)), []string{"image/*"}, time.Minute, secret), allowedTypes: []string{"image/jpeg"}, expectedStatus: http.StatusBadRequest},
+		{name: "no type in common", token: createToken(int64(len(img)), []string{"image/png"}, time.Minute, secret), allowedTypes: []string{"image/jpeg"}, expectedStatus: http.StatusBadRequest},
+	}
+
+	for _, entry := range presignedTests {
+		uploadDir := t.TempDir()
+
+		request := newUploadRequest(t, []testUpload{{field: "file", filename: "cyborg-ape.png", content: img}}, nil)
+		request.URL.RawQuery = url.Values{"token": {entry.token}}.Encode()
+		rr := httptest.NewRecorder()
+
+		testTools.AllowedFileTypes = entry.allowedTypes
+		testTools.MaxFileSize = entry.maxFileSize
+		testTools.HandlePresignedUpload(rr, request, secret, uploadDir)
+
+		if rr.Code != entry.expectedStatus {
+			t.Errorf("%s: status set to %d, expected %d: %s", entry.name, rr.Code, entry.expectedStatus, rr.Body.String())
+		}
+
+		stored, _ := os.ReadDir(uploadDir)
+		if entry.expectedStatus == http.StatusCreated && len(stored) != 1 {
+			t.Errorf("%s: expected 1 stored file, found %d", entry.name, len(stored))
+		}
+
+		if entry.expectedStatus != http.StatusCreated && len(stored) != 0 {
+			t.Errorf("%s: expected no stored files, found %d", entry.name, len(stored))
+		}
+	}
+}
+
+func TestTools_UploadFilesFromField(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	uploadDir := t.TempDir()
+
+	request := newUploadRequest(t, []testUpload{
+		{field: "avatar", filename: "avatar.png", content: img},
+		{field: "attachment", filename: "attachment.txt", content: []byte("not an avatar")},
+	}, nil)
+
+	files, err := testTools.UploadFilesFromField(request, "avatar", uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].OriginalFileName != "avatar.png" {
+		t.Fatalf("expected only avatar.png to be uploaded, got %v", files)
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "avatar.png")); os.IsNotExist(err) {
+		t.Errorf("expected file to exist: %s", err.Error())
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "attachment.txt")); !os.IsNotExist(err) {
+		t.Error("file from another field should not have been saved")
+	}
+
+	request = newUploadRequest(t, []testUpload{{field: "attachment", filename: "attachment.txt", content: []byte("not an avatar")}}, nil)
+
+	files, err = testTools.UploadFilesFromField(request, "avatar", t.TempDir(), false)
+	if !errors.Is(err, ErrNoFiles) || len(files) != 0 {
+		t.Errorf("expected ErrNoFiles for a missing field, got %v and %d files", err, len(files))
+	}
+}
+
+var validateJSONTests = []struct {
+	name          string
+	json          string
+	kind          string
+	errorExpected bool
+	expectedError error
+}{
+	{name: "object", json: `{"foo": {"bar": [1, 2, 3]}}`, kind: "object"},
+	{name: "array", json: `[{"foo": "bar"}, {"foo": "baz"}]`, kind: "array"},
+	{name: "string scalar", json: `"hello"`, kind: "scalar"},
+	{name: "number scalar", json: ` 42 `, kind: "scalar"},
+	{name: "malformed", json: `{"foo": "bar"]`, errorExpected: true, expectedError: ErrBadlyFormedJSON},
+	{name: "truncated", json: `{"foo": "bar"`, errorExpected: true, expectedError: ErrBadlyFormedJSON},
+	{name: "empty", json: ``, errorExpected: true, expectedError: ErrEmptyBody},
+	{name: "multiple payloads", json: `{"foo": "bar"}{"foo": "baz"}`, errorExpected: true, expectedError: ErrMultiplePayloads},
+	{name: "too large", json: `{"foo": "` + strings.Repeat("x", 600) + `"}`, errorExpected: true, expectedError: ErrBodyTooLarge},
+}
+
+func TestTools_ValidateJSON(t *testing.T) {
+	var testTools Tools
+	testTools.MaxJSONSize = 512
+
+	for _, entry := range validateJSONTests {
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(entry.json))
+
+		kind, size, err := testTools.ValidateJSON(req)
+
+		if entry.errorExpected {
+			if !errors.Is(err, entry.expectedError) {
+				t.Errorf("%s: expected error matching %q, got %v", entry.name, entry.expectedError, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		if kind != entry.kind {
+			t.Errorf("%s: kind set to %s, expected %s", entry.name, kind, entry.kind)
+		}
+
+		if size != len(entry.json) {
+			t.Errorf("%s: size set to %d, expected %d", entry.name, size, len(entry.json))
+		}
+	}
+}
+
+func TestTools_ErrorJSONForRequest(t *testing.T) {
+	var testTools Tools
+	testTools.ErrorContextFunc = func(r *http.Request) map[string]string {
+		return map[string]string{"request_id": r.Header.Get("X-Request-ID"), "trace_id": "trace-123"}
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "req-456")
+	rr := httptest.NewRecorder()
+
+	err := testTools.ErrorJSONForRequest(rr, req, errors.New("this is a test error"), http.StatusNotFound)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var payload JSONResponse
+	if err = json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Error("error decoding JSON", err)
+	}
+
+	if payload.Meta["request_id"] != "req-456" || payload.Meta["trace_id"] != "trace-123" {
+		t.Errorf("unexpected meta fields %v", payload.Meta)
+	}
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("request status set to %d, expected %d", rr.Code, http.StatusNotFound)
+	}
+
+	// without a context function the meta field is omitted entirely
+	testTools.ErrorContextFunc = nil
+	rr = httptest.NewRecorder()
+
+	_ = testTools.ErrorJSONForRequest(rr, req, errors.New("this is a test error"))
+
+	if strings.Contains(rr.Body.String(), "meta") {
+		t.Errorf("meta field should be omitted: %s", rr.Body.String())
+	}
+}
+
+func TestTools_UploadFilesToMemory(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.AllowedFileTypes = []string{"image/png"}
+
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "cyborg-ape.png", content: img}}, nil)
+
+	files, err := testTools.UploadFilesToMemory(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(files))
+	}
+
+	if !bytes.Equal(files[0].Data, img) {
+		t.Error("in-memory data does not match the uploaded file")
+	}
+
+	if files[0].FileType != "image/png" || files[0].FileSize != int64(len(img)) || files[0].OriginalFileName != "cyborg-ape.png" {
+		t.Errorf("unexpected file details %s, %s, %d", files[0].OriginalFileName, files[0].FileType, files[0].FileSize)
+	}
+
+	request = newUploadRequest(t, []testUpload{{field: "file", filename: "notes.txt", content: []byte("plain text")}}, nil)
+
+	_, err = testTools.UploadFilesToMemory(request)
+	if err == nil {
+		t.Error("disallowed file type accepted, but an error was expected")
+	}
+
+	// files are read in field order, whatever the concurrency, and every file is logged
+	for _, concurrency := range []int{1, 3} {
+		logger := &recordingLogger{}
+		orderedTools := Tools{Logger: logger, UploadConcurrency: concurrency}
+
+		request = newUploadRequest(t, []testUpload{
+			{field: "c", filename: "c.txt", content: []byte("ccc")},
+			{field: "a", filename: "a.txt", content: []byte("a")},
+			{field: "b", filename: "b.txt", content: []byte("bb")},
+		}, nil)
+
+		files, err = orderedTools.UploadFilesToMemory(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var names []string
+		for _, file := range files {
+			names = append(names, file.OriginalFileName)
+		}
+
+		if !reflect.DeepEqual(names, []string{"a.txt", "b.txt", "c.txt"}) {
+			t.Errorf("concurrency %d: files read in the order %v, expected a.txt, b.txt, c.txt", concurrency, names)
+		}
+
+		if concurrency == 1 {
+			expected := []string{
+				"info: upload started size=1",
+				"info: upload completed size=1",
+				"info: upload started size=2",
+				"info: upload completed size=2",
+				"info: upload started size=3",
+				"info: upload completed size=3",
+			}
+
+			if !reflect.DeepEqual(logger.events, expected) {
+				t.Errorf("logged %v, expected %v", logger.events, expected)
+			}
+		}
+	}
+}
+
+func TestTools_ReadString(t *testing.T) {
+	var testTools Tools
+	testTools.MaxBodySize = 16
+
+	body := "event=paid&id=9"
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	s, err := testTools.ReadString(rr, req)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if s != body {
+		t.Errorf("body read as %q, expected %q", s, body)
+	}
+
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(strings.Repeat("x", 17)))
+
+	_, err = testTools.ReadString(rr, req)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("expected body too large error, got %v", err)
+	}
+
+	if err != nil && err.Error() != "body must not be larger than 16 bytes" {
+		t.Errorf("unexpected error message: %s", err.Error())
+	}
+}
+
+var corsTests = []struct {
+	name              string
+	config            CORSConfig
+	method            string
+	origin            string
+	expectedStatus    int
+	expectedOrigin    string
+	expectCredentials bool
+	handlerCalled     bool
+}{
+	{name: "preflight", config: CORSConfig{AllowedOrigins: []string{"https://app.example.com"}, MaxAge: 600}, method: "OPTIONS", origin: "https://app.example.com", expectedStatus: http.StatusNoContent, expectedOrigin: "https://app.example.com", handlerCalled: false},
+	{name: "preflight disallowed origin", config: CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}, method: "OPTIONS", origin: "https://evil.example.com", expectedStatus: http.StatusForbidden, expectedOrigin: "", handlerCalled: false},
+	{name: "simple request", config: CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}, method: "GET", origin: "https://app.example.com", expectedStatus: http.StatusOK, expectedOrigin: "https://app.example.com", handlerCalled: true},
+	{name: "disallowed origin", config: CORSConfig{AllowedOrigins: []string{"https://app.example.com"}}, method: "GET", origin: "https://evil.example.com", expectedStatus: http.StatusOK, expectedOrigin: "", handlerCalled: true},
+	{name: "wildcard", config: CORSConfig{AllowedOrigins: []string{"*"}}, method: "GET", origin: "https://any.example.com", expectedStatus: http.StatusOK, expectedOrigin: "*", handlerCalled: true},
+	{name: "wildcard with credentials", config: CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, method: "GET", origin: "https://any.example.com", expectedStatus: http.StatusOK, expectedOrigin: "*", expectCredentials: false, handlerCalled: true},
+	{name: "preflight wildcard with credentials", config: CORSConfig{AllowedOrigins: []string{"*"}, AllowCredentials: true}, method: "OPTIONS", origin: "https://any.example.com", expectedStatus: http.StatusNoContent, expectedOrigin: "*", expectCredentials: false, handlerCalled: false},
+	{name: "listed origin with credentials beside wildcard", config: CORSConfig{AllowedOrigins: []string{"*", "https://app.example.com"}, AllowCredentials: true}, method: "GET", origin: "https://app.example.com", expectedStatus: http.StatusOK, expectedOrigin: "https://app.example.com", expectCredentials: true, handlerCalled: true},
+	{name: "no origin", config: CORSConfig{AllowedOrigins: []string{"*"}}, method: "GET", origin: "", expectedStatus: http.StatusOK, expectedOrigin: "", handlerCalled: true},
+}
+
+func TestTools_CORSMiddleware(t *testing.T) {
+	for _, entry := range corsTests {
+		var testTools Tools
+		testTools.CORS = entry.config
+
+		handlerCalled := false
+		handler := testTools.CORSMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerCalled = true
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		req, _ := http.NewRequest(entry.method, "/", nil)
+		if entry.origin != "" {
+			req.Header.Set("Origin", entry.origin)
+		}
+		if entry.method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != entry.expectedStatus {
+			t.Errorf("%s: status set to %d, expected %d", entry.name, rr.Code, entry.expectedStatus)
+		}
+
+		if actual := rr.Header().Get("Access-Control-Allow-Origin"); actual != entry.expectedOrigin {
+			t.Errorf("%s: allowed origin set to %q, expected %q", entry.name, actual, entry.expectedOrigin)
+		}
+
+		if entry.expectCredentials != (rr.Header().Get("Access-Control-Allow-Credentials") == "true") {
+			t.Errorf("%s: unexpected credentials header %q", entry.name, rr.Header().Get("Access-Control-Allow-Credentials"))
+		}
+
+		if handlerCalled != entry.handlerCalled {
+			t.Errorf("%s: handler called set to %t, expected %t", entry.name, handlerCalled, entry.handlerCalled)
+		}
+
+		if vary := rr.Header().Values("Vary"); (entry.origin != "") != (len(vary) == 1 && vary[0] == "Origin") {
+			t.Errorf("%s: unexpected Vary header %q", entry.name, vary)
+		}
+
+		if entry.name == "preflight" {
+			if rr.Header().Get("Access-Control-Allow-Methods") == "" {
+				t.Errorf("%s: expected allowed methods header", entry.name)
+			}
+
+			if rr.Header().Get("Access-Control-Max-Age") != "600" {
+				t.Errorf("%s: max age set to %q, expected 600", entry.name, rr.Header().Get("Access-Control-Max-Age"))
+			}
+		}
+	}
+}
+
+var writeTextTests = []struct {
+	name        string
+	html        bool
+	status      int
+	body        string
+	contentType string
+}{
+	{name: "text", html: false, status: http.StatusOK, body: "hello, world", contentType: "text/plain; charset=utf-8"},
+	{name: "html", html: true, status: http.StatusNotFound, body: "<h1>Not Found</h1>", contentType: "text/html; charset=utf-8"},
+}
+
+func TestTools_WriteTextAndHTML(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range writeTextTests {
+		rr := httptest.NewRecorder()
+
+		headers := make(http.Header)
+		headers.Add("FOO", "BAR")
+
+		var err error
+		if entry.html {
+			err = testTools.WriteHTML(rr, entry.status, entry.body, headers)
+		} else {
+			err = testTools.WriteText(rr, entry.status, entry.body, headers)
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", entry.name, err)
+		}
+
+		if rr.Code != entry.status {
+			t.Errorf("%s: status set to %d, expected %d", entry.name, rr.Code, entry.status)
+		}
+
+		if rr.Header().Get("Content-Type") != entry.contentType {
+			t.Errorf("%s: content type set to %s, expected %s", entry.name, rr.Header().Get("Content-Type"), entry.contentType)
+		}
+
+		if rr.Header().Get("FOO") != "BAR" {
+			t.Errorf("%s: expected custom header to be set", entry.name)
+		}
+
+		if rr.Body.String() != entry.body {
+			t.Errorf("%s: body set to %s, expected %s", entry.name, rr.Body.String(), entry.body)
+		}
+	}
+}
+
+func TestTools_ReadJSONWithRaw(t *testing.T) {
+	var testTools Tools
+	testTools.MaxJSONSize = 64
+
+	body := `{"foo":  "bar"}` + "\n"
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	raw, err := testTools.ReadJSONWithRaw(rr, req, &decodedJSON)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if string(raw) != body {
+		t.Errorf("raw body %q does not match input %q", raw, body)
+	}
+
+	if decodedJSON.Foo != "bar" {
+		t.Errorf("decoded foo set to %s, expected bar", decodedJSON.Foo)
+	}
+
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(`{"foo": "bar"`))
+	raw, err = testTools.ReadJSONWithRaw(rr, req, &decodedJSON)
+	if !errors.Is(err, ErrBadlyFormedJSON) {
+		t.Errorf("expected badly formed JSON error, got %v", err)
+	}
+
+	if string(raw) != `{"foo": "bar"` {
+		t.Errorf("raw body should be returned with a decode error, got %q", raw)
+	}
+
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(`{"foo": "`+strings.Repeat("x", 64)+`"}`))
+	_, err = testTools.ReadJSONWithRaw(rr, req, &decodedJSON)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("expected body too large error, got %v", err)
+	}
+}
+
+func TestTools_UploadFilesRemovesTempFiles(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tempDir := t.TempDir()
+	t.Setenv("TMPDIR", tempDir)
+
+	// a tiny memory limit makes ParseMultipartForm spill the file to a temporary file
+	var testTools Tools
+	testTools.MaxUploadMemory = 1
+
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "cyborg-ape.png", content: img}}, nil)
+
+	_, err = testTools.UploadFiles(request, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if request.MultipartForm == nil {
+		t.Fatal("expected the multipart form to have been parsed")
+	}
+
+	leftovers, err := os.ReadDir(tempDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(leftovers) != 0 {
+		t.Errorf("expected temporary files to be removed, found %d", len(leftovers))
+	}
+}
+
+var paginationTests = []struct {
+	name           string
+	query          string
+	expectedPage   int
+	expectedSize   int
+	expectedOffset int
+	errorExpected  bool
+}{
+	{name: "missing params", query: "", expectedPage: 1, expectedSize: 20, expectedOffset: 0, errorExpected: false},
+	{name: "page and size", query: "page=3&page_size=10", expectedPage: 3, expectedSize: 10, expectedOffset: 20, errorExpected: false},
+	{name: "oversized size", query: "page=2&page_size=1000000", expectedPage: 2, expectedSize: 100, expectedOffset: 100, errorExpected: false},
+	{name: "non-numeric page", query: "page=abc", errorExpected: true},
+	{name: "negative page", query: "page=-1", errorExpected: true},
+	{name: "zero page", query: "page=0", errorExpected: true},
+	{name: "non-numeric size", query: "page_size=lots", errorExpected: true},
+	{name: "negative size", query: "page_size=-5", errorExpected: true},
+	{name: "offset overflow", query: "page=" + strconv.Itoa(math.MaxInt) + "&page_size=100", errorExpected: true},
+	{name: "largest page", query: "page=" + strconv.Itoa(math.MaxInt/100+1) + "&page_size=100", expectedPage: math.MaxInt/100 + 1, expectedSize: 100, expectedOffset: math.MaxInt / 100 * 100, errorExpected: false},
+}
+
+func TestTools_ReadPagination(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range paginationTests {
+		req, _ := http.NewRequest("GET", "/items?"+entry.query, nil)
+
+		page, size, offset, err := testTools.ReadPagination(req, 20, 100)
+
+		if entry.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", entry.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		if page != entry.expectedPage || size != entry.expectedSize || offset != entry.expectedOffset {
+			t.Errorf("%s: got page %d, size %d, offset %d; expected %d, %d, %d", entry.name, page, size, offset, entry.expectedPage, entry.expectedSize, entry.expectedOffset)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", "/items", nil)
+	for _, sizes := range [][2]int{{0, 100}, {-1, 100}, {200, 100}} {
+		if _, _, _, err := testTools.ReadPagination(req, sizes[0], sizes[1]); err == nil {
+			t.Errorf("default size %d with maximum %d: error expected, but none received", sizes[0], sizes[1])
+		}
+	}
+
+	if _, size, _, err := testTools.ReadPagination(req, 500, 0); err != nil || size != 500 {
+		t.Errorf("no maximum: expected a page size of 500, got %d and %v", size, err)
+	}
+}
+
+func TestTools_WriteJSONStream(t *testing.T) {
+	var testTools Tools
+
+	type record struct {
+		ID int `json:"id"`
+	}
+
+	ch := make(chan interface{})
+	go func() {
+		defer close(ch)
+		for i := 1; i <= 250; i++ {
+			ch <- record{ID: i}
+		}
+	}()
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSONStream(rr, http.StatusOK, ch)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var records []record
+	if err = json.Unmarshal(rr.Body.Bytes(), &records); err != nil {
+		t.Fatalf("streamed output is not valid JSON: %v", err)
+	}
+
+	if len(records) != 250 || records[0].ID != 1 || records[249].ID != 250 {
+		t.Errorf("unexpected records streamed: %d", len(records))
+	}
+
+	if !rr.Flushed {
+		t.Error("expected the response to be flushed")
+	}
+
+	// an empty channel still produces an empty array
+	empty := make(chan interface{})
+	close(empty)
+
+	rr = httptest.NewRecorder()
+	_ = testTools.WriteJSONStream(rr, http.StatusOK, empty)
+
+	if rr.Body.String() != "[]" {
+		t.Errorf("expected [] for an empty stream, got %s", rr.Body.String())
+	}
+
+	// a value that can't be marshalled surfaces an error
+	bad := make(chan interface{}, 2)
+	bad <- record{ID: 1}
+	bad <- make(chan int)
+	close(bad)
+
+	rr = httptest.NewRecorder()
+	err = testTools.WriteJSONStream(rr, http.StatusOK, bad)
+	if err == nil {
+		t.Error("expected marshal error but none received")
+	}
+
+	// a zero status defaults to 200
+	empty = make(chan interface{})
+	close(empty)
+
+	rr = httptest.NewRecorder()
+	err = testTools.WriteJSONStream(rr, 0, empty)
+	if err != nil {
+		t.Errorf("zero status: error not expected, but received - %s", err.Error())
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("zero status: status set to %d, expected %d", rr.Code, http.StatusOK)
+	}
+
+	// an invalid status is rejected before anything is written
+	rr = httptest.NewRecorder()
+	err = testTools.WriteJSONStream(rr, 999, empty)
+	if err == nil {
+		t.Error("invalid status: error expected, but none received")
+	}
+
+	if rr.Body.Len() != 0 || len(rr.Header()) != 0 {
+		t.Errorf("invalid status: nothing should be written, got %q", rr.Body.String())
+	}
+}
+
+func TestTools_UploadFilesWildcardTypes(t *testing.T) {
+	png, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jpeg, err := os.ReadFile("./testdata/tipfinger.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdf := []byte("%PDF-1.4\n%âãÏÓ\n1 0 obj << /Type /Catalog >> endobj\n")
+
+	var wildcardTests = []struct {
+		name          string
+		allowedTypes  []string
+		filename      string
+		content       []byte
+		errorExpected bool
+	}{
+		{name: "png with wildcard", allowedTypes: []string{"image/*"}, filename: "ape.png", content: png, errorExpected: false},
+		{name: "jpeg with wildcard", allowedTypes: []string{"image/*"}, filename: "finger.jpg", content: jpeg, errorExpected: false},
+		{name: "pdf with wildcard", allowedTypes: []string{"image/*"}, filename: "doc.pdf", content: pdf, errorExpected: true},
+		{name: "pdf with mixed entries", allowedTypes: []string{"image/*", "application/pdf"}, filename: "doc.pdf", content: pdf, errorExpected: false},
+		{name: "text with wildcard", allowedTypes: []string{"text/*"}, filename: "notes.txt", content: []byte("some notes"), errorExpected: false},
+		{name: "text with exact type", allowedTypes: []string{"text/plain"}, filename: "notes.txt", content: []byte("some notes"), errorExpected: false},
+	}
+
+	for _, entry := range wildcardTests {
+		var testTools Tools
+		testTools.AllowedFileTypes = entry.allowedTypes
+
+		request := newUploadRequest(t, []testUpload{{field: "file", filename: entry.filename, content: entry.content}}, nil)
+
+		_, err := testTools.UploadFiles(request, t.TempDir())
+
+		if entry.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", entry.name)
+		}
+
+		if !entry.errorExpected && err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+	}
+}
+
+func TestTools_WriteSuccess(t *testing.T) {
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	err := testTools.WriteSuccess(rr, http.StatusOK, "user found", map[string]string{"name": "bob"})
+	if err != nil {
+		t.Error(err)
+	}
+
+	var payload JSONResponse
+	if err = json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Error("error decoding JSON", err)
+	}
+
+	if payload.Error {
+		t.Error("error set to `true` but should be `false`")
+	}
+
+	if payload.Message != "user found" {
+		t.Errorf("message set to %s, expected user found", payload.Message)
+	}
+
+	data, ok := payload.Data.(map[string]interface{})
+	if !ok || data["name"] != "bob" {
+		t.Errorf("unexpected data %v", payload.Data)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("request status set to %d, expected %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestTools_UploadFilesBaseUploadDir(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	base := t.TempDir()
+
+	var baseDirTests = []struct {
+		name          string
+		uploadDir     string
+		errorExpected bool
+	}{
+		{name: "in bounds", uploadDir: filepath.Join(base, "tenant-a"), errorExpected: false},
+		{name: "base itself", uploadDir: base, errorExpected: false},
+		{name: "escaping", uploadDir: filepath.Join(base, "tenant-a", "..", "..", "escaped"), errorExpected: true},
+		{name: "unrelated", uploadDir: t.TempDir(), errorExpected: true},
+		{name: "sibling with shared prefix", uploadDir: base + "-evil", errorExpected: true},
+	}
+
+	for _, entry := range baseDirTests {
+		var testTools Tools
+		testTools.BaseUploadDir = base
+
+		request := newUploadRequest(t, []testUpload{{field: "file", filename: "ape.png", content: img}}, nil)
+
+		_, err := testTools.UploadFiles(request, entry.uploadDir)
+
+		if entry.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", entry.name)
+		}
+
+		if !entry.errorExpected && err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(filepath.Dir(base), "escaped")); !os.IsNotExist(err) {
+		t.Error("escaping upload directory should not have been created")
+	}
+}
+
+func TestTools_UploadFilesNameLength(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nameTests = []struct {
+		name     string
+		length   int
+		prefix   string
+		expected int
+	}{
+		{name: "default length", length: 0, prefix: "", expected: 25},
+		{name: "short", length: 8, prefix: "", expected: 8},
+		{name: "long with prefix", length: 40, prefix: "avatar_", expected: 40},
+	}
+
+	for _, entry := range nameTests {
+		var testTools Tools
+		testTools.UploadNameLength = entry.length
+		testTools.UploadNamePrefix = entry.prefix
+
+		request := newUploadRequest(t, []testUpload{{field: "file", filename: "ape.png", content: img}}, nil)
+
+		files, err := testTools.UploadFiles(request, t.TempDir())
+		if err != nil {
+			t.Fatalf("%s: %v", entry.name, err)
+		}
+
+		name := files[0].NewFileName
+		if !strings.HasPrefix(name, entry.prefix) || !strings.HasSuffix(name, ".png") {
+			t.Errorf("%s: name %s should start with %q and end with .png", entry.name, name, entry.prefix)
+		}
+
+		if len(name) != len(entry.prefix)+entry.expected+len(".png") {
+			t.Errorf("%s: name %s has length %d, expected %d", entry.name, name, len(name), len(entry.prefix)+entry.expected+len(".png"))
+		}
+	}
+}
+
+func TestTools_UploadFilesRenameCollision(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadDir := t.TempDir()
+	existing := filepath.Join(uploadDir, "collision.png")
+	if err = os.WriteFile(existing, []byte("original content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+
+	// the first generated name collides with the existing file, later ones are random
+	attempts := 0
+	testTools.uploadRandomString = func(n int) string {
+		attempts++
+		if attempts == 1 {
+			return "collision"
+		}
+		return testTools.RandomString(n)
+	}
+
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "ape.png", content: img}}, nil)
+
+	files, err := testTools.UploadFiles(request, uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts != 2 {
+		t.Errorf("generated %d names, expected 2", attempts)
+	}
+
+	if files[0].NewFileName == "collision.png" {
+		t.Error("colliding name was used for the upload")
+	}
+
+	original, err := os.ReadFile(existing)
+	if err != nil || string(original) != "original content" {
+		t.Error("existing file was overwritten")
+	}
+
+	// a name that always collides eventually gives up
+	testTools.uploadRandomString = func(n int) string {
+		return "collision"
+	}
+
+	request = newUploadRequest(t, []testUpload{{field: "file", filename: "ape.png", content: img}}, nil)
+
+	_, err = testTools.UploadFiles(request, uploadDir)
+	if !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected a file exists error, got %v", err)
+	}
+}
+
+func TestTools_ReadJSONOrError(t *testing.T) {
+	var testTools Tools
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"foo": "bar"}`))
+	rr := httptest.NewRecorder()
+
+	if !testTools.ReadJSONOrError(rr, req, &decodedJSON) {
+		t.Error("expected valid JSON to return true")
+	}
+
+	if rr.Body.Len() != 0 {
+		t.Errorf("nothing should be written on success, got %s", rr.Body.String())
+	}
+
+	if decodedJSON.Foo != "bar" {
+		t.Errorf("decoded foo set to %s, expected bar", decodedJSON.Foo)
+	}
+
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(`{"foo": "bar"`))
+	rr = httptest.NewRecorder()
+
+	if testTools.ReadJSONOrError(rr, req, &decodedJSON) {
+		t.Error("expected malformed JSON to return false")
+	}
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("request status set to %d, expected %d", rr.Code, http.StatusBadRequest)
+	}
+
+	var payload JSONResponse
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil || !payload.Error {
+		t.Errorf("expected a JSON error response, got %s", rr.Body.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(`{"foo": 1}`))
+	rr = httptest.NewRecorder()
+
+	testTools.ReadJSONOrError(rr, req, &decodedJSON, http.StatusUnprocessableEntity)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("request status set to %d, expected %d", rr.Code, http.StatusUnprocessableEntity)
+	}
+}
+
+func TestTools_RateLimitMiddleware(t *testing.T) {
+	var testTools Tools
+	testTools.RateLimit = RateLimitConfig{Rate: 1, Burst: 3, TrustedProxies: []string{"192.0.2.10", "10.0.0.0/8"}}
+
+	handler := testTools.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	statuses := make([]int, 5)
+	for i := range statuses {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "192.0.2.10:54321"
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+		statuses[i] = rr.Code
+
+		if rr.Code == http.StatusTooManyRequests && rr.Header().Get("Retry-After") == "" {
+			t.Errorf("request %d: expected a Retry-After header", i)
+		}
+	}
+
+	for i, status := range statuses {
+		expected := http.StatusOK
+		if i >= 3 {
+			expected = http.StatusTooManyRequests
+		}
+
+		if status != expected {
+			t.Errorf("request %d: status set to %d, expected %d", i, status, expected)
+		}
+	}
+
+	// a different client behind the trusted proxies has its own bucket
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "192.0.2.10:54321"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7, 10.0.0.1")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("forwarded client: status set to %d, expected %d", rr.Code, http.StatusOK)
+	}
+}
+
+func TestTools_WriteJSONDefaultHeaders(t *testing.T) {
+	var testTools Tools
+	testTools.DefaultResponseHeaders = http.Header{
+		"Cache-Control": {"public, max-age=60"},
+		"Vary":          {"Accept-Encoding"},
+	}
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSON(rr, http.StatusOK, Envelope{"foo": "bar"})
+	if err != nil {
+		t.Errorf("failed to write JSON: %v", err)
+	}
+
+	if rr.Header().Get("Cache-Control") != "public, max-age=60" || rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("default headers missing from response: %v", rr.Header())
+	}
+
+	rr = httptest.NewRecorder()
+	headers := http.Header{"Cache-Control": {"no-store"}}
+
+	err = testTools.WriteJSON(rr, http.StatusOK, Envelope{"foo": "bar"}, headers)
+	if err != nil {
+		t.Errorf("failed to write JSON: %v", err)
+	}
+
+	if rr.Header().Get("Cache-Control") != "no-store" {
+		t.Errorf("per-call header should override the default, got %s", rr.Header().Get("Cache-Control"))
+	}
+
+	if rr.Header().Get("Vary") != "Accept-Encoding" {
+		t.Error("non-colliding default header should still be set")
+	}
+}
+
+func TestTools_WriteJSONDefaultHeadersKeepMiddlewareHeaders(t *testing.T) {
+	var testTools Tools
+	testTools.CORS = CORSConfig{AllowedOrigins: []string{"https://example.com"}}
+	testTools.DefaultResponseHeaders = http.Header{
+		"Vary":         {"Accept"},
+		"X-Request-Id": {"default"},
+	}
+
+	handler := testTools.CORSMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-Id", "abc123")
+		_ = testTools.WriteJSON(w, http.StatusOK, Envelope{"foo": "bar"})
+	}))
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Origin", "https://example.com")
+	rr := httptest.NewRecorder()
+
+	handler.ServeHTTP(rr, req)
+
+	vary := strings.Join(rr.Header().Values("Vary"), ", ")
+	if !strings.Contains(vary, "Origin") || !strings.Contains(vary, "Accept") {
+		t.Errorf("Vary should list both Origin and Accept, got %q", vary)
+	}
+
+	if rr.Header().Get("X-Request-Id") != "abc123" {
+		t.Errorf("default header replaced middleware header, got %q", rr.Header().Get("X-Request-Id"))
+	}
+
+	rr.Header().Add("Vary", "Cookie")
+	if len(testTools.DefaultResponseHeaders["Vary"]) != 1 {
+		t.Errorf("response shares header values with DefaultResponseHeaders: %v", testTools.DefaultResponseHeaders)
+	}
+}
+
+func TestTools_SignPayload(t *testing.T) {
+	var testTools Tools
+	secret := "webhook-secret"
+	body := []byte(`{"event": "paid", "amount": 100}`)
+
+	signature := testTools.SignPayload(secret, body)
+
+	if !testTools.VerifySignature(secret, body, signature) {
+		t.Error("valid signature failed verification")
+	}
+
+	if !testTools.VerifySignature(secret, body, "sha256="+signature) {
+		t.Error("valid prefixed signature failed verification")
+	}
+
+	if testTools.VerifySignature(secret, []byte(`{"event": "paid", "amount": 1000}`), signature) {
+		t.Error("tampered body passed verification")
+	}
+
+	if testTools.VerifySignature("wrong-secret", body, signature) {
+		t.Error("signature passed verification with the wrong secret")
+	}
+}
+
+func TestTools_UploadFilesContentTypeDetector(t *testing.T) {
+	docx := []byte("PK\x03\x04 pretend this is an office document")
+
+	var testTools Tools
+	testTools.AllowedFileTypes = []string{"application/vnd.openxmlformats-officedocument.wordprocessingml.document"}
+
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "report.docx", content: docx}}, nil)
+	_, err := testTools.UploadFiles(request, t.TempDir())
+	if err == nil {
+		t.Error("expected the default detector to reject the document")
+	}
+
+	var detectedName string
+	testTools.ContentTypeDetector = func(data []byte, filename string) string {
+		detectedName = filename
+		if bytes.HasPrefix(data, []byte("PK\x03\x04")) && strings.HasSuffix(filename, ".docx") {
+			return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+		}
+		return http.DetectContentType(data)
+	}
+
+	request = newUploadRequest(t, []testUpload{{field: "file", filename: "report.docx", content: docx}}, nil)
+	_, err = testTools.UploadFiles(request, t.TempDir())
+	if err != nil {
+		t.Errorf("custom detector should allow the document: %v", err)
+	}
+
+	if detectedName != "report.docx" {
+		t.Errorf("detector received filename %s, expected report.docx", detectedName)
+	}
+}
+
+type requiredAddress struct {
+	City string `json:"city"`
+}
+
+type requiredPayload struct {
+	Name    string           `json:"name"`
+	Age     int              `json:"age"`
+	Address *requiredAddress `json:"address"`
+}
+
+var validateRequiredTests = []struct {
+	name          string
+	data          interface{}
+	fields        []string
+	missing       string
+	errorExpected bool
+}{
+	{name: "all present", data: requiredPayload{Name: "Jack", Age: 30, Address: &requiredAddress{City: "Austin"}}, fields: []string{"Name", "Age", "Address.City"}},
+	{name: "pointer to struct", data: &requiredPayload{Name: "Jack"}, fields: []string{"Name"}},
+	{name: "missing field", data: requiredPayload{Age: 30}, fields: []string{"Age", "Name"}, missing: "Name", errorExpected: true},
+	{name: "json key", data: requiredPayload{Name: "Jack"}, fields: []string{"name", "age"}, missing: "age", errorExpected: true},
+	{name: "nil nested pointer", data: requiredPayload{Name: "Jack"}, fields: []string{"Address.City"}, missing: "Address.City", errorExpected: true},
+	{name: "empty nested field", data: requiredPayload{Address: &requiredAddress{}}, fields: []string{"Address.City"}, missing: "Address.City", errorExpected: true},
+	{name: "unknown field", data: requiredPayload{}, fields: []string{"Email"}, errorExpected: true},
+	{name: "not a struct", data: "Jack", fields: []string{"Name"}, errorExpected: true},
+}
+
+func TestTools_ValidateRequired(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range validateRequiredTests {
+		err := testTools.ValidateRequired(entry.data, entry.fields...)
+
+		if !entry.errorExpected {
+			if err != nil {
+				t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+			}
+			continue
+		}
+
+		if err == nil {
+			t.Errorf("%s: error expected, but none received", entry.name)
+			continue
+		}
+
+		var missingFieldError *MissingFieldError
+		if entry.missing == "" {
+			if errors.As(err, &missingFieldError) {
+				t.Errorf("%s: expected a usage error, got %v", entry.name, err)
+			}
+			continue
+		}
+
+		if !errors.As(err, &missingFieldError) || missingFieldError.Field != entry.missing {
+			t.Errorf("%s: expected missing field %s, got %v", entry.name, entry.missing, err)
+		}
+
+		if !errors.Is(err, ErrMissingField) {
+			t.Errorf("%s: expected error to match ErrMissingField", entry.name)
+		}
+	}
+}
+
+var noFilesUploadTests = []struct {
+	name string
+	body string
+}{
+	{name: "empty body", body: ""},
+	{name: "no parts", body: "--boundary--\r\n"},
+	{name: "fields only", body: "--boundary\r\nContent-Disposition: form-data; name=\"title\"\r\n\r\nhello\r\n--boundary--\r\n"},
+}
+
+func TestTools_UploadFilesNoFiles(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range noFilesUploadTests {
+		request := httptest.NewRequest("POST", "/", strings.NewReader(entry.body))
+		request.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+
+		_, err := testTools.UploadFiles(request, t.TempDir())
+		if !errors.Is(err, ErrNoFiles) {
+			t.Errorf("%s: expected ErrNoFiles from UploadFiles, got %v", entry.name, err)
+		}
+
+		request = httptest.NewRequest("POST", "/", strings.NewReader(entry.body))
+		request.Header.Set("Content-Type", "multipart/form-data; boundary=boundary")
+
+		_, err = testTools.UploadFilesToMemory(request)
+		if !errors.Is(err, ErrNoFiles) {
+			t.Errorf("%s: expected ErrNoFiles from UploadFilesToMemory, got %v", entry.name, err)
+		}
+	}
+}
+
+func TestTools_UploadOneFileNoFile(t *testing.T) {
+	var testTools Tools
+
+	request := newUploadRequest(t, nil, map[string]string{"title": "no attachment"})
+
+	file, err := testTools.UploadOneFile(request, t.TempDir())
+	if !errors.Is(err, ErrNoFiles) {
+		t.Errorf("expected ErrNoFiles, got %v", err)
+	}
+
+	if file != nil {
+		t.Errorf("expected no file, got %v", file)
+	}
+}
+
+func TestTools_UploadFilesDateBasedPath(t *testing.T) {
+	var testTools Tools
+	testTools.DateBasedUploadPath = true
+	testTools.uploadNow = func() time.Time {
+		return time.Date(2024, time.June, 12, 15, 4, 5, 0, time.UTC)
+	}
+
+	uploadDir := t.TempDir()
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "notes.txt", content: []byte("some notes")}}, nil)
+
+	files, err := testTools.UploadFiles(request, uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files[0].Path != "2024/06/12/notes.txt" {
+		t.Errorf("path set to %s, expected 2024/06/12/notes.txt", files[0].Path)
+	}
+
+	if files[0].NewFileName != "notes.txt" {
+		t.Errorf("new file name set to %s, expected notes.txt", files[0].NewFileName)
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "2024", "06", "12", "notes.txt")); err != nil {
+		t.Errorf("expected file to exist in the dated directory: %s", err.Error())
+	}
+}
+
+var writeJSONCompressedTests = []struct {
+	name           string
+	payload        string
+	acceptEncoding string
+	level          int
+	expectedLevel  int
+	compressed     bool
+}{
+	{name: "under threshold", payload: "small", acceptEncoding: "gzip", compressed: false},
+	{name: "over threshold", payload: strings.Repeat("large ", 100), acceptEncoding: "gzip", level: gzip.BestSpeed, expectedLevel: gzip.BestSpeed, compressed: true},
+	{name: "best compression", payload: strings.Repeat("large ", 100), acceptEncoding: "br, gzip;q=0.8", level: gzip.BestCompression, expectedLevel: gzip.BestCompression, compressed: true},
+	{name: "invalid level", payload: strings.Repeat("large ", 100), acceptEncoding: "gzip", level: 42, expectedLevel: gzip.DefaultCompression, compressed: true},
+	{name: "gzip not accepted", payload: strings.Repeat("large ", 100), acceptEncoding: "br", compressed: false},
+	{name: "gzip refused", payload: strings.Repeat("large ", 100), acceptEncoding: "gzip;q=0", compressed: false},
+}
+
+func TestTools_WriteJSONCompressed(t *testing.T) {
+	for _, entry := range writeJSONCompressedTests {
+		var testTools Tools
+		testTools.GzipMinSize = 100
+		testTools.GzipLevel = entry.level
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", entry.acceptEncoding)
+		rr := httptest.NewRecorder()
+
+		payload := JSONResponse{Message: entry.payload}
+		err := testTools.WriteJSONCompressed(rr, req, http.StatusOK, payload)
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+			continue
+		}
+
+		expected, _ := json.Marshal(payload)
+
+		if !entry.compressed {
+			if rr.Header().Get("Content-Encoding") != "" {
+				t.Errorf("%s: response should not be compressed", entry.name)
+			}
+			if !bytes.Equal(rr.Body.Bytes(), expected) {
+				t.Errorf("%s: body set to %s, expected %s", entry.name, rr.Body.String(), expected)
+			}
+			continue
+		}
+
+		if rr.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("%s: response should be gzip compressed", entry.name)
+			continue
+		}
+
+		var buf bytes.Buffer
+		gz, _ := gzip.NewWriterLevel(&buf, entry.expectedLevel)
+		_, _ = gz.Write(expected)
+		_ = gz.Close()
+
+		if !bytes.Equal(rr.Body.Bytes(), buf.Bytes()) {
+			t.Errorf("%s: body was not compressed at level %d", entry.name, entry.expectedLevel)
+		}
+	}
+}
+
+func TestTools_WriteJSONCompressedVary(t *testing.T) {
+	var testTools Tools
+	testTools.GzipMinSize = 1
+	testTools.DefaultResponseHeaders = http.Header{"Vary": {"Accept"}}
+
+	for _, acceptEncoding := range []string{"gzip", ""} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		rr := httptest.NewRecorder()
+		rr.Header().Set("Vary", "Origin")
+
+		err := testTools.WriteJSONCompressed(rr, req, http.StatusOK, Envelope{"foo": "bar"}, http.Header{"Vary": {"Cookie"}})
+		if err != nil {
+			t.Errorf("%q: error not expected, but received - %s", acceptEncoding, err.Error())
+			continue
+		}
+
+		vary := strings.Join(rr.Header().Values("Vary"), ", ")
+		for _, name := range []string{"Origin", "Accept", "Cookie", "Accept-Encoding"} {
+			found := false
+			for _, listed := range strings.Split(vary, ",") {
+				if strings.TrimSpace(listed) == name {
+					found = true
+				}
+			}
+
+			if !found {
+				t.Errorf("%q: Vary %q is missing %s", acceptEncoding, vary, name)
+			}
+		}
+	}
+}
+
+var clientIPTests = []struct {
+	name         string
+	remoteAddr   string
+	forwardedFor string
+	realIP       string
+	expectedIP   string
+}{
+	{name: "no headers", remoteAddr: "203.0.113.7:5000", expectedIP: "203.0.113.7"},
+	{name: "spoofed from untrusted peer", remoteAddr: "203.0.113.7:5000", forwardedFor: "1.2.3.4", realIP: "5.6.7.8", expectedIP: "203.0.113.7"},
+	{name: "trusted proxy", remoteAddr: "10.0.0.2:5000", forwardedFor: "198.51.100.9", expectedIP: "198.51.100.9"},
+	{name: "chain through trusted proxies", remoteAddr: "10.0.0.2:5000", forwardedFor: "1.2.3.4, 198.51.100.9, 10.0.0.5", expectedIP: "198.51.100.9"},
+	{name: "all hops trusted", remoteAddr: "10.0.0.2:5000", forwardedFor: "10.0.0.9, 10.0.0.5", expectedIP: "10.0.0.9"},
+	{name: "malformed hop", remoteAddr: "10.0.0.2:5000", forwardedFor: "198.51.100.9, bogus", expectedIP: "10.0.0.2"},
+	{name: "real ip", remoteAddr: "10.0.0.2:5000", realIP: "198.51.100.9", expectedIP: "198.51.100.9"},
+	{name: "ipv6 peer", remoteAddr: "[2001:db8::1]:5000", forwardedFor: "1.2.3.4", expectedIP: "2001:db8::1"},
+	{name: "ipv6 trusted proxy", remoteAddr: "[fd00::2]:5000", forwardedFor: "[2001:db8::7]:443", expectedIP: "2001:db8::7"},
+}
+
+func TestTools_ClientIP(t *testing.T) {
+	var testTools Tools
+	trustedProxies := []string{"10.0.0.0/8", "fd00::2"}
+
+	for _, entry := range clientIPTests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.RemoteAddr = entry.remoteAddr
+		if entry.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", entry.forwardedFor)
+		}
+		if entry.realIP != "" {
+			req.Header.Set("X-Real-IP", entry.realIP)
+		}
+
+		ip := testTools.ClientIP(req, trustedProxies)
+		if ip != entry.expectedIP {
+			t.Errorf("%s: client IP set to %s, expected %s", entry.name, ip, entry.expectedIP)
+		}
+	}
+}
+
+// failingWriter is a ResponseWriter whose writes always fail, e.g. because the client has gone away
+type failingWriter struct {
+	header http.Header
+}
+
+func (f *failingWriter) Header() http.Header {
+	return f.header
+}
+
+func (f *failingWriter) Write([]byte) (int, error) {
+	return 0, errors.New("connection reset by peer")
+}
+
+func (f *failingWriter) WriteHeader(int) {}
+
+func TestTools_WriteJSONWriteError(t *testing.T) {
+	var testTools Tools
+
+	err := testTools.WriteJSON(&failingWriter{header: http.Header{}}, http.StatusOK, JSONResponse{Message: "foo"})
+	if err == nil || err.Error() != "connection reset by peer" {
+		t.Errorf("expected the write error to be returned, got %v", err)
+	}
+}
+
+func TestTools_WriteGuardMiddleware(t *testing.T) {
+	var testTools Tools
+
+	var firstErr, secondErr error
+	handler := testTools.WriteGuardMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		firstErr = testTools.WriteJSON(w, http.StatusCreated, JSONResponse{Message: "first"})
+		secondErr = testTools.WriteJSON(w, http.StatusInternalServerError, JSONResponse{Error: true, Message: "second"})
+	}))
+
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+	handler.ServeHTTP(rr, req)
+
+	if firstErr != nil {
+		t.Errorf("first write should succeed, got %v", firstErr)
+	}
+
+	if !errors.Is(secondErr, ErrResponseAlreadyWritten) {
+		t.Errorf("expected ErrResponseAlreadyWritten, got %v", secondErr)
+	}
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("status set to %d, expected %d", rr.Code, http.StatusCreated)
+	}
+
+	if strings.Contains(rr.Body.String(), "second") {
+		t.Error("second response should not have been written")
+	}
+}
+
+func TestTools_WriteGuardMiddlewareHijack(t *testing.T) {
+	var testTools Tools
+
+	writeErr := make(chan error, 1)
+	handler := testTools.WriteGuardMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hijacker, ok := w.(http.Hijacker)
+		if !ok {
+			writeErr <- errors.New("guarded writer does not implement http.Hijacker")
+			return
+		}
+
+		conn, buf, err := hijacker.Hijack()
+		if err != nil {
+			writeErr <- err
+			return
+		}
+		defer conn.Close()
+
+		_, _ = buf.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		_ = buf.Flush()
+
+		writeErr <- testTools.WriteJSON(w, http.StatusOK, JSONResponse{Message: "too late"})
+	}))
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hijacked" {
+		t.Errorf("expected the body written to the hijacked connection, got %q", body)
+	}
+
+	if err := <-writeErr; !errors.Is(err, ErrResponseAlreadyWritten) {
+		t.Errorf("expected ErrResponseAlreadyWritten after hijacking, got %v", err)
+	}
+
+	guard := &writeGuard{ResponseWriter: httptest.NewRecorder()}
+	if _, _, err := guard.Hijack(); !errors.Is(err, http.ErrNotSupported) {
+		t.Errorf("expected http.ErrNotSupported from a writer that cannot hijack, got %v", err)
+	}
+}
+
+type signupForm struct {
+	Email    string   `form:"email"`
+	Age      int      `form:"age"`
+	Score    float64  `form:"score"`
+	Optin    bool     `form:"optin"`
+	Tags     []string `form:"tag"`
+	Name     string
+	Internal string `form:"-"`
+}
+
+var readFormTests = []struct {
+	name          string
+	body          string
+	allowUnknown  bool
+	errorExpected bool
+	expectedError error
+}{
+	{name: "valid", body: "email=jack%40example.com&age=42&score=9.5&optin=true&tag=a&tag=b&Name=Jack"},
+	{name: "unknown field", body: "email=jack%40example.com&nickname=jj", errorExpected: true, expectedError: ErrUnknownField},
+	{name: "allowed unknown field", body: "email=jack%40example.com&nickname=jj", allowUnknown: true},
+	{name: "skipped field", body: "Internal=secret", errorExpected: true, expectedError: ErrUnknownField},
+	{name: "invalid int", body: "age=forty", errorExpected: true, expectedError: ErrInvalidFormValue},
+	{name: "invalid bool", body: "optin=sure", errorExpected: true, expectedError: ErrInvalidFormValue},
+	{name: "too large", body: "email=" + strings.Repeat("x", 600), errorExpected: true, expectedError: ErrBodyTooLarge},
+}
+
+func TestTools_ReadForm(t *testing.T) {
+	for _, entry := range readFormTests {
+		var testTools Tools
+		testTools.MaxBodySize = 512
+		testTools.AllowUnknownFields = entry.allowUnknown
+
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(entry.body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rr := httptest.NewRecorder()
+
+		var form signupForm
+		err := testTools.ReadForm(rr, req, &form)
+
+		if entry.errorExpected {
+			if !errors.Is(err, entry.expectedError) {
+				t.Errorf("%s: expected error matching %q, got %v", entry.name, entry.expectedError, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+	}
+
+	var testTools Tools
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(readFormTests[0].body))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	var form signupForm
+	if err := testTools.ReadForm(httptest.NewRecorder(), req, &form); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := signupForm{Email: "jack@example.com", Age: 42, Score: 9.5, Optin: true, Tags: []string{"a", "b"}, Name: "Jack"}
+	if !reflect.DeepEqual(form, expected) {
+		t.Errorf("form decoded as %+v, expected %+v", form, expected)
+	}
+}
+
+func TestTools_ReadFormMultipart(t *testing.T) {
+	newRequest := func(values url.Values) *http.Request {
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		for key, list := range values {
+			for _, value := range list {
+				_ = writer.WriteField(key, value)
+			}
+		}
+		_ = writer.Close()
+
+		req, _ := http.NewRequest("POST", "/", &body)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+
+		return req
+	}
+
+	var testTools Tools
+	testTools.MaxBodySize = 1024
+
+	values := url.Values{"email": {"jack@example.com"}, "age": {"42"}, "tag": {"a", "b"}}
+
+	var form signupForm
+	if err := testTools.ReadForm(httptest.NewRecorder(), newRequest(values), &form); err != nil {
+		t.Fatalf("error not expected, but received - %s", err.Error())
+	}
+
+	expected := signupForm{Email: "jack@example.com", Age: 42, Tags: []string{"a", "b"}}
+	if !reflect.DeepEqual(form, expected) {
+		t.Errorf("multipart form decoded as %+v, expected %+v", form, expected)
+	}
+
+	err := testTools.ReadForm(httptest.NewRecorder(), newRequest(url.Values{"nickname": {"jj"}}), &form)
+	if !errors.Is(err, ErrUnknownField) {
+		t.Errorf("unknown field: expected ErrUnknownField, got %v", err)
+	}
+
+	err = testTools.ReadForm(httptest.NewRecorder(), newRequest(url.Values{"email": {strings.Repeat("x", 2048)}}), &form)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("too large: expected ErrBodyTooLarge, got %v", err)
+	}
+}
+
+func TestTools_UploadFilesDisallowedTypes(t *testing.T) {
+	png, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pdf := []byte("%PDF-1.4\n%âãÏÓ\n1 0 obj << /Type /Catalog >> endobj\n")
+
+	var disallowedTests = []struct {
+		name          string
+		allowedTypes  []string
+		deniedTypes   []string
+		filename      string
+		content       []byte
+		errorExpected bool
+	}{
+		{name: "denied type", deniedTypes: []string{"application/pdf"}, filename: "doc.pdf", content: pdf, errorExpected: true},
+		{name: "other type", deniedTypes: []string{"application/pdf"}, filename: "ape.png", content: png, errorExpected: false},
+		{name: "denied category", deniedTypes: []string{"text/*"}, filename: "shell.php", content: []byte("<?php echo 'hi'; ?>"), errorExpected: true},
+		{name: "deny takes precedence", allowedTypes: []string{"image/*", "application/pdf"}, deniedTypes: []string{"application/pdf"}, filename: "doc.pdf", content: pdf, errorExpected: true},
+		{name: "allowed and not denied", allowedTypes: []string{"image/*", "application/pdf"}, deniedTypes: []string{"application/pdf"}, filename: "ape.png", content: png, errorExpected: false},
+	}
+
+	for _, entry := range disallowedTests {
+		var testTools Tools
+		testTools.AllowedFileTypes = entry.allowedTypes
+		testTools.DisallowedFileTypes = entry.deniedTypes
+
+		request := newUploadRequest(t, []testUpload{{field: "file", filename: entry.filename, content: entry.content}}, nil)
+
+		_, err := testTools.UploadFiles(request, t.TempDir())
+
+		if entry.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", entry.name)
+		}
+
+		if !entry.errorExpected && err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+	}
+}
+
+func TestTools_ProxyJSON(t *testing.T) {
+	var forwarded string
+	upstreamBody := `{"id": 7, "status": "created"}`
+
+	client := MockTestClient(func(req *http.Request) *http.Response {
+		body, _ := io.ReadAll(req.Body)
+		forwarded = string(body)
+		return &http.Response{
+			StatusCode: http.StatusCreated,
+			Body:       io.NopCloser(bytes.NewBufferString(upstreamBody)),
+			Header:     http.Header{"Content-Type": []string{"application/json"}},
+		}
+	})
+
+	var testTools Tools
+	testTools.MaxJSONSize = 64
+
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(`{"name": "widget"}`))
+	rr := httptest.NewRecorder()
+
+	err := testTools.ProxyJSON(rr, req, "http://example.net/widgets", client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if forwarded != `{"name": "widget"}` {
+		t.Errorf("forwarded body set to %s, expected the inbound body", forwarded)
+	}
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("status set to %d, expected %d", rr.Code, http.StatusCreated)
+	}
+
+	if rr.Body.String() != upstreamBody {
+		t.Errorf("body set to %s, expected %s", rr.Body.String(), upstreamBody)
+	}
+
+	// an inbound body over the limit is never forwarded
+	forwarded = ""
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(`{"name": "`+strings.Repeat("x", 100)+`"}`))
+	rr = httptest.NewRecorder()
+
+	err = testTools.ProxyJSON(rr, req, "http://example.net/widgets", client)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("expected ErrBodyTooLarge, got %v", err)
+	}
+
+	if rr.Code != http.StatusRequestEntityTooLarge || forwarded != "" {
+		t.Errorf("oversized inbound body should be rejected with %d, got %d", http.StatusRequestEntityTooLarge, rr.Code)
+	}
+
+	// an upstream response over the limit is not relayed
+	upstreamBody = `{"data": "` + strings.Repeat("x", 100) + `"}`
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(`{"name": "widget"}`))
+	rr = httptest.NewRecorder()
+
+	err = testTools.ProxyJSON(rr, req, "http://example.net/widgets", client)
+	if err == nil {
+		t.Error("expected an error for an oversized upstream response")
+	}
+
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("status set to %d, expected %d", rr.Code, http.StatusBadGateway)
+	}
+}
+
+// recordingLogger collects the messages logged through it
+type recordingLogger struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (l *recordingLogger) Info(msg string, keyvals ...interface{}) {
+	l.record("info: "+msg, keyvals...)
+}
+
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) {
+	l.record("error: "+msg, keyvals...)
+}
+
+func (l *recordingLogger) record(event string, keyvals ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for i := 0; i+1 < len(keyvals); i += 2 {
+		if keyvals[i] == "status" || keyvals[i] == "size" {
+			event += fmt.Sprintf(" %v=%v", keyvals[i], keyvals[i+1])
+		}
+	}
+	l.events = append(l.events, event)
+}
+
+func TestTools_Logger(t *testing.T) {
+	logger := &recordingLogger{}
+
+	var testTools Tools
+	testTools.Logger = logger
+
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "notes.txt", content: []byte("some notes")}}, nil)
+	if _, err := testTools.UploadFiles(request, t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+
+	client := MockTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       io.NopCloser(bytes.NewBufferString("ok")),
+			Header:     make(http.Header),
+		}
+	})
+
+	if _, _, err := testTools.PushJSONToRemote("http://example.net", map[string]string{"foo": "bar"}, client); err != nil {
+		t.Fatal(err)
+	}
+
+	testTools.AllowedFileTypes = []string{"image/png"}
+	request = newUploadRequest(t, []testUpload{{field: "file", filename: "notes.txt", content: []byte("some notes")}}, nil)
+	_, _ = testTools.UploadFiles(request, t.TempDir())
+
+	expected := []string{
+		"info: upload started size=10",
+		"info: upload completed size=10",
+		"info: remote push completed status=202",
+		"info: upload started size=10",
+		"error: upload failed",
+	}
+
+	if !reflect.DeepEqual(logger.events, expected) {
+		t.Errorf("logged %v, expected %v", logger.events, expected)
+	}
+}
+
+var jsonDepthTests = []struct {
+	name          string
+	json          string
+	maxDepth      int
+	expectedError error
+}{
+	{name: "within limit", json: `{"foo": {"bar": [1, 2]}}`, maxDepth: 3},
+	{name: "unlimited", json: strings.Repeat("[", 50) + strings.Repeat("]", 50), maxDepth: 0},
+	{name: "too deep", json: `{"foo": {"bar": [[1]]}}`, maxDepth: 3, expectedError: ErrJSONTooDeep},
+	{name: "deeply nested arrays", json: strings.Repeat("[", 1000) + strings.Repeat("]", 1000), maxDepth: 32, expectedError: ErrJSONTooDeep},
+	{name: "malformed", json: `{"foo": `, maxDepth: 3, expectedError: ErrBadlyFormedJSON},
+}
+
+func TestTools_ReadJSONMaxDepth(t *testing.T) {
+	for _, entry := range jsonDepthTests {
+		var testTools Tools
+		testTools.MaxJSONDepth = entry.maxDepth
+		testTools.AllowUnknownFields = true
+
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(entry.json))
+		rr := httptest.NewRecorder()
+
+		var decoded interface{}
+		err := testTools.ReadJSON(rr, req, &decoded)
+
+		if entry.expectedError == nil {
+			if err != nil {
+				t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+			}
+			continue
+		}
+
+		if !errors.Is(err, entry.expectedError) {
+			t.Errorf("%s: expected error matching %q, got %v", entry.name, entry.expectedError, err)
+		}
+	}
+}
+
+var serveFromDirTests = []struct {
+	name           string
+	requestedName  string
+	asAttachment   bool
+	expectedStatus int
+	disposition    string
+}{
+	{name: "inline file", requestedName: "tipfinger.jpg", expectedStatus: http.StatusOK, disposition: `inline; filename="tipfinger.jpg"`},
+	{name: "attachment", requestedName: "cyborg-ape.png", asAttachment: true, expectedStatus: http.StatusOK, disposition: `attachment; filename="cyborg-ape.png"`},
+	{name: "traversal", requestedName: "../tools.go", expectedStatus: http.StatusForbidden},
+	{name: "nested traversal", requestedName: "uploads/../../tools.go", expectedStatus: http.StatusForbidden},
+	{name: "absolute name", requestedName: "/etc/passwd", expectedStatus: http.StatusNotFound},
+	{name: "missing file", requestedName: "missing.png", expectedStatus: http.StatusNotFound},
+	{name: "directory", requestedName: "uploads", expectedStatus: http.StatusNotFound},
+}
+
+func TestTools_ServeFromDir(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range serveFromDirTests {
+		rr := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/", nil)
+
+		testTools.ServeFromDir(rr, req, "./testdata", entry.requestedName, entry.asAttachment)
+
+		if rr.Code != entry.expectedStatus {
+			t.Errorf("%s: status set to %d, expected %d", entry.name, rr.Code, entry.expectedStatus)
+		}
+
+		if entry.disposition != "" && rr.Header().Get("Content-Disposition") != entry.disposition {
+			t.Errorf("%s: disposition set to %s, expected %s", entry.name, rr.Header().Get("Content-Disposition"), entry.disposition)
+		}
+	}
+}
+
+func TestTools_ServeFromDirSymlink(t *testing.T) {
+	baseDir, outsideDir := t.TempDir(), t.TempDir()
+
+	secret := filepath.Join(outsideDir, "secret.txt")
+	if err := os.WriteFile(secret, []byte("top secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(secret, filepath.Join(baseDir, "link.txt")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+
+	var testTools Tools
+	rr := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/", nil)
+
+	testTools.ServeFromDir(rr, req, baseDir, "link.txt", false)
+
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("status set to %d, expected %d", rr.Code, http.StatusForbidden)
+	}
+}
+
+var queryAccessorTests = []struct {
+	name           string
+	query          string
+	expectedString string
+	expectedInt    int
+	expectedBool   bool
+}{
+	{name: "valid", query: "?value=1", expectedString: "1", expectedInt: 1, expectedBool: true},
+	{name: "valid words", query: "?value=false", expectedString: "false", expectedInt: 7, expectedBool: false},
+	{name: "invalid", query: "?value=banana", expectedString: "banana", expectedInt: 7, expectedBool: true},
+	{name: "empty", query: "?value=", expectedString: "fallback", expectedInt: 7, expectedBool: true},
+	{name: "absent", query: "", expectedString: "fallback", expectedInt: 7, expectedBool: true},
+}
+
+func TestTools_QueryAccessors(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range queryAccessorTests {
+		req, _ := http.NewRequest("GET", "/"+entry.query, nil)
+
+		if s := testTools.QueryString(req, "value", "fallback"); s != entry.expectedString {
+			t.Errorf("%s: QueryString returned %s, expected %s", entry.name, s, entry.expectedString)
+		}
+
+		if n := testTools.QueryInt(req, "value", 7); n != entry.expectedInt {
+			t.Errorf("%s: QueryInt returned %d, expected %d", entry.name, n, entry.expectedInt)
+		}
+
+		if b := testTools.QueryBool(req, "value", true); b != entry.expectedBool {
+			t.Errorf("%s: QueryBool returned %t, expected %t", entry.name, b, entry.expectedBool)
+		}
+	}
+}
+
+var uploadSizeTests = []struct {
+	name          string
+	maxFileSize   int
+	maxMemory     int
+	errorExpected bool
+}{
+	{name: "larger than memory limit", maxFileSize: 1024, maxMemory: 16, errorExpected: false},
+	{name: "larger than file limit", maxFileSize: 100, maxMemory: 16, errorExpected: true},
+	{name: "file limit above memory default", maxFileSize: 64 << 20, errorExpected: false},
+}
+
+func TestTools_UploadFilesMaxUploadMemory(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 500)
+
+	for _, entry := range uploadSizeTests {
+		var testTools Tools
+		testTools.MaxFileSize = entry.maxFileSize
+		testTools.MaxUploadMemory = entry.maxMemory
+
+		uploadDir := t.TempDir()
+		request := newUploadRequest(t, []testUpload{{field: "file", filename: "notes.txt", content: content}}, nil)
+
+		files, err := testTools.UploadFiles(request, uploadDir, false)
+
+		if entry.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", entry.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+			continue
+		}
+
+		if files[0].FileSize != int64(len(content)) {
+			t.Errorf("%s: file size set to %d, expected %d", entry.name, files[0].FileSize, len(content))
+		}
+	}
+}
+
+var securityHeadersTests = []struct {
+	name     string
+	config   SecurityHeadersConfig
+	tls      bool
+	expected map[string]string
+}{
+	{
+		name: "defaults",
+		expected: map[string]string{
+			"X-Content-Type-Options":    "nosniff",
+			"X-Frame-Options":           "DENY",
+			"Referrer-Policy":           "strict-origin-when-cross-origin",
+			"Strict-Transport-Security": "",
+		},
+	},
+	{
+		name:   "overrides",
+		config: SecurityHeadersConfig{FrameOptions: "SAMEORIGIN", ReferrerPolicy: "no-referrer"},
+		expected: map[string]string{
+			"X-Frame-Options": "SAMEORIGIN",
+			"Referrer-Policy": "no-referrer",
+		},
+	},
+	{
+		name:     "hsts over plain http",
+		config:   SecurityHeadersConfig{HSTSMaxAge: 31536000},
+		expected: map[string]string{"Strict-Transport-Security": ""},
+	},
+	{
+		name:     "hsts over tls",
+		config:   SecurityHeadersConfig{HSTSMaxAge: 31536000, HSTSIncludeSubdomains: true},
+		tls:      true,
+		expected: map[string]string{"Strict-Transport-Security": "max-age=31536000; includeSubDomains"},
+	},
+}
+
+func TestTools_SecurityHeadersMiddleware(t *testing.T) {
+	for _, entry := range securityHeadersTests {
+		var testTools Tools
+		testTools.SecurityHeaders = entry.config
+
+		handlerCalled := false
+		handler := testTools.SecurityHeadersMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			handlerCalled = true
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		req := httptest.NewRequest("GET", "http://example.com/", nil)
+		if entry.tls {
+			req = httptest.NewRequest("GET", "https://example.com/", nil)
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if !handlerCalled {
+			t.Errorf("%s: handler was not called", entry.name)
+		}
+
+		for key, value := range entry.expected {
+			if rr.Header().Get(key) != value {
+				t.Errorf("%s: %s set to %q, expected %q", entry.name, key, rr.Header().Get(key), value)
+			}
+		}
+	}
+}
+
+func TestTools_SaveBase64File(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(img)
+
+	var base64Tests = []struct {
+		name          string
+		data          string
+		allowedTypes  []string
+		maxFileSize   int
+		rename        bool
+		errorExpected bool
+	}{
+		{name: "data uri", data: "data:image/png;base64," + encoded, allowedTypes: []string{"image/png"}},
+		{name: "plain base64", data: encoded, rename: true},
+		{name: "unpadded base64", data: base64.RawStdEncoding.EncodeToString(img), rename: true},
+		{name: "declared type mismatch", data: "data:image/jpeg;base64," + encoded, errorExpected: true},
+		{name: "type not allowed", data: encoded, allowedTypes: []string{"image/jpeg"}, errorExpected: true},
+		{name: "not base64 data uri", data: "data:image/png," + encoded, errorExpected: true},
+		{name: "invalid base64", data: "not*base64!", errorExpected: true},
+		{name: "too large", data: encoded, maxFileSize: 100, errorExpected: true},
+	}
+
+	for _, entry := range base64Tests {
+		var testTools Tools
+		testTools.AllowedFileTypes = entry.allowedTypes
+		testTools.MaxFileSize = entry.maxFileSize
+
+		uploadDir := t.TempDir()
+		file, err := testTools.SaveBase64File(entry.data, uploadDir, entry.rename)
+
+		if entry.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", entry.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+			continue
+		}
+
+		if filepath.Ext(file.NewFileName) != ".png" {
+			t.Errorf("%s: file saved as %s, expected a .png extension", entry.name, file.NewFileName)
+		}
+
+		if !entry.rename && file.NewFileName != "upload.png" {
+			t.Errorf("%s: file saved as %s, expected upload.png", entry.name, file.NewFileName)
+		}
+
+		saved, err := os.ReadFile(filepath.Join(uploadDir, file.NewFileName))
+		if err != nil {
+			t.Errorf("%s: expected file to exist: %s", entry.name, err.Error())
+			continue
+		}
+
+		if !bytes.Equal(saved, img) || file.FileSize != int64(len(img)) {
+			t.Errorf("%s: saved file does not match the original", entry.name)
+		}
+	}
+
+	// parameters in the declared type do not stop it matching the detected type
+	var testTools Tools
+	text := base64.StdEncoding.EncodeToString([]byte("hello, world"))
+
+	for _, declared := range []string{"text/plain;charset=utf-8", "TEXT/PLAIN; charset=UTF-8", "text/plain"} {
+		file, err := testTools.SaveBase64File("data:"+declared+";base64,"+text, t.TempDir(), false)
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", declared, err.Error())
+			continue
+		}
+
+		if file.NewFileName != "upload.txt" {
+			t.Errorf("%s: file saved as %s, expected upload.txt", declared, file.NewFileName)
+		}
+	}
+
+	if _, err := testTools.SaveBase64File("data:text/html;charset=utf-8;base64,"+text, t.TempDir(), false); err == nil {
+		t.Error("different media type: error expected, but none received")
+	}
+}
+
+var writeJSONStatusTests = []struct {
+	name           string
+	status         int
+	expectedStatus int
+	errorExpected  bool
+}{
+	{name: "zero", status: 0, expectedStatus: http.StatusOK},
+	{name: "created", status: http.StatusCreated, expectedStatus: http.StatusCreated},
+	{name: "too high", status: 999, errorExpected: true},
+	{name: "too low", status: 42, errorExpected: true},
+	{name: "negative", status: -1, errorExpected: true},
+}
+
+func TestTools_WriteJSONStatus(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range writeJSONStatusTests {
+		rr := httptest.NewRecorder()
+
+		err := testTools.WriteJSON(rr, entry.status, JSONResponse{Message: "foo"})
+
+		if entry.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", entry.name)
+			}
+			if rr.Body.Len() != 0 {
+				t.Errorf("%s: nothing should be written for an invalid status", entry.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		if rr.Code != entry.expectedStatus {
+			t.Errorf("%s: status set to %d, expected %d", entry.name, rr.Code, entry.expectedStatus)
+		}
+	}
+}
+
+// memorySink collects the files written to it by UploadFilesTo
+type memorySink struct {
+	mu     sync.Mutex
+	files  map[string]*bytes.Buffer
+	types  map[string]string
+	closed int
+}
+
+func (m *memorySink) create(filename, fileType string) (io.WriteCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	m.files[filename] = buf
+	m.types[filename] = fileType
+	return &memorySinkWriter{Buffer: buf, sink: m}, nil
+}
+
+type memorySinkWriter struct {
+	*bytes.Buffer
+	sink *memorySink
+}
+
+func (w *memorySinkWriter) Close() error {
+	w.sink.mu.Lock()
+	w.sink.closed++
+	w.sink.mu.Unlock()
+	return nil
+}
+
+func TestTools_UploadFilesTo(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &memorySink{files: make(map[string]*bytes.Buffer), types: make(map[string]string)}
+
+	var testTools Tools
+	testTools.AllowedFileTypes = []string{"image/png"}
+
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "ape.png", content: img}}, nil)
+
+	files, err := testTools.UploadFilesTo(request, sink.create, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || files[0].NewFileName != "ape.png" || files[0].FileSize != int64(len(img)) {
+		t.Fatalf("unexpected uploaded files %v", files)
+	}
+
+	if !bytes.Equal(sink.files["ape.png"].Bytes(), img) {
+		t.Error("bytes written to the sink do not match the upload")
+	}
+
+	if sink.types["ape.png"] != "image/png" || sink.closed != 1 {
+		t.Errorf("sink received type %s and was closed %d times", sink.types["ape.png"], sink.closed)
+	}
+
+	// files that fail validation never reach the sink
+	sink = &memorySink{files: make(map[string]*bytes.Buffer), types: make(map[string]string)}
+	request = newUploadRequest(t, []testUpload{{field: "file", filename: "notes.txt", content: []byte("some notes")}}, nil)
+
+	_, err = testTools.UploadFilesTo(request, sink.create)
+	if err == nil {
+		t.Error("expected an error for a disallowed file type")
+	}
+
+	if len(sink.files) != 0 {
+		t.Errorf("disallowed file was written to the sink")
+	}
+
+	// files go through the same ordered, concurrent path as UploadFiles
+	testTools.UploadConcurrency = 3
+	sink = &memorySink{files: make(map[string]*bytes.Buffer), types: make(map[string]string)}
+	request = newUploadRequest(t, []testUpload{
+		{field: "photos", filename: "c.png", content: img},
+		{field: "avatar", filename: "a.png", content: img},
+		{field: "notes", filename: "b.txt", content: []byte("some notes")},
+		{field: "photos", filename: "d.png", content: img},
+	}, nil)
+
+	files, err = testTools.UploadFilesTo(request, sink.create, false)
+
+	var uploadErrs UploadErrors
+	if !errors.As(err, &uploadErrs) || len(uploadErrs.Errors()) != 1 {
+		t.Errorf("expected one upload error, got %v", err)
+	}
+
+	var names []string
+	for _, file := range files {
+		names = append(names, file.NewFileName)
+	}
+
+	if strings.Join(names, ",") != "a.png,c.png,d.png" || sink.closed != 3 {
+		t.Errorf("expected a.png, c.png, and d.png in order with 3 closes, got %v and %d", names, sink.closed)
+	}
+}
+
+func TestTools_ValidationErrorJSON(t *testing.T) {
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	errs := map[string]string{"email": "must be a valid email address", "age": "must be at least 18"}
+
+	err := testTools.ValidationErrorJSON(rr, errs, http.StatusUnprocessableEntity)
+	if err != nil {
+		t.Error(err)
+	}
+
+	var payload JSONResponse
+	decoder := json.NewDecoder(rr.Body)
+	err = decoder.Decode(&payload)
+	if err != nil {
+		t.Error("received error when decoding JSON", err)
+	}
+
+	if !payload.Error || payload.Message == "" {
+		t.Error("error set to false or message missing in JSON, and it should be an error with a message")
+	}
+
+	if !reflect.DeepEqual(payload.Errors, errs) {
+		t.Errorf("errors set to %v, expected %v", payload.Errors, errs)
+	}
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Errorf("wrong status code returned; expected 422, but got %d", rr.Code)
+	}
+}
+
+func TestTools_UploadFilesWithOptionsModTime(t *testing.T) {
+	modTime := time.Date(2019, time.March, 4, 10, 30, 0, 0, time.UTC)
+
+	var testTools Tools
+	uploadDir := t.TempDir()
+
+	request := newUploadRequest(t, []testUpload{
+		{field: "file", filename: "old.txt", content: []byte("archived notes")},
+		{field: "file", filename: "new.txt", content: []byte("fresh notes")},
+	}, nil)
+
+	files, err := testTools.UploadFilesWithOptions(request, uploadDir, UploadOptions{
+		KeepOriginalName: true,
+		ModTime: func(fileHeader *multipart.FileHeader) time.Time {
+			if fileHeader.Filename == "old.txt" {
+				return modTime
+			}
+			return time.Time{}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 {
+		t.Fatalf("uploaded %d files, expected 2", len(files))
+	}
+
+	info, err := os.Stat(filepath.Join(uploadDir, "old.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !info.ModTime().Equal(modTime) {
+		t.Errorf("modification time set to %s, expected %s", info.ModTime(), modTime)
+	}
+
+	info, err = os.Stat(filepath.Join(uploadDir, "new.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.ModTime().Equal(modTime) {
+		t.Error("file without a supplied time should keep the time it was saved")
+	}
+}
+
+func TestTools_PushToRemote(t *testing.T) {
+	var contentType, body string
+
+	client := MockTestClient(func(req *http.Request) *http.Response {
+		contentType = req.Header.Get("Content-Type")
+		b, _ := io.ReadAll(req.Body)
+		body = string(b)
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(bytes.NewBufferString("ok")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var testTools Tools
+
+	form := url.Values{"name": {"Jack"}, "role": {"admin"}}
+	_, status, err := testTools.PushToRemote("http://example.net", "application/x-www-form-urlencoded", strings.NewReader(form.Encode()), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf("status set to %d, expected %d", status, http.StatusOK)
+	}
+
+	if contentType != "application/x-www-form-urlencoded" {
+		t.Errorf("content type set to %s, expected application/x-www-form-urlencoded", contentType)
+	}
+
+	if body != form.Encode() {
+		t.Errorf("body set to %s, expected %s", body, form.Encode())
+	}
+
+	_, _, err = testTools.PushJSONToRemote("http://example.net", map[string]string{"foo": "bar"}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/json" || body != `{"foo":"bar"}` {
+		t.Errorf("PushJSONToRemote sent %s with content type %s", body, contentType)
+	}
+}
+
+var writeJSONPTests = []struct {
+	name                string
+	query               string
+	expectedBody        string
+	expectedContentType string
+	errorExpected       bool
+}{
+	{name: "valid callback", query: "?callback=handleData", expectedBody: `/**/handleData({"foo":"bar"});`, expectedContentType: "application/javascript"},
+	{name: "dotted callback", query: "?callback=app.handlers.data_1", expectedBody: `/**/app.handlers.data_1({"foo":"bar"});`, expectedContentType: "application/javascript"},
+	{name: "no callback", query: "", expectedBody: `{"foo":"bar"}`, expectedContentType: "application/json"},
+	{name: "script injection", query: "?callback=" + url.QueryEscape("alert(document.cookie);//"), errorExpected: true},
+	{name: "html injection", query: "?callback=" + url.QueryEscape("<script>"), errorExpected: true},
+	{name: "leading digit", query: "?callback=1abc", errorExpected: true},
+	{name: "too long", query: "?callback=" + strings.Repeat("a", 129), errorExpected: true},
+}
+
+func TestTools_WriteJSONP(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range writeJSONPTests {
+		req, _ := http.NewRequest("GET", "/"+entry.query, nil)
+		rr := httptest.NewRecorder()
+
+		err := testTools.WriteJSONP(rr, req, http.StatusOK, map[string]string{"foo": "bar"}, "callback")
+
+		if entry.errorExpected {
+			if err == nil {
+				t.Errorf("%s: error expected, but none received", entry.name)
+			}
+			if rr.Body.Len() != 0 {
+				t.Errorf("%s: nothing should be written for an invalid callback, got %s", entry.name, rr.Body.String())
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		if rr.Body.String() != entry.expectedBody {
+			t.Errorf("%s: body set to %s, expected %s", entry.name, rr.Body.String(), entry.expectedBody)
+		}
+
+		if rr.Header().Get("Content-Type") != entry.expectedContentType {
+			t.Errorf("%s: content type set to %s, expected %s", entry.name, rr.Header().Get("Content-Type"), entry.expectedContentType)
+		}
+	}
+}
+
+var requestIDTests = []struct {
+	name      string
+	incoming  string
+	preserved bool
+}{
+	{name: "incoming id", incoming: "req-123.abc", preserved: true},
+	{name: "missing id", incoming: ""},
+	{name: "unsafe id", incoming: "bad id\r\nSet-Cookie: x"},
+	{name: "too long", incoming: strings.Repeat("a", 129)},
+}
+
+func TestTools_RequestIDMiddleware(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range requestIDTests {
+		var contextID string
+		handler := testTools.RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			contextID = RequestIDFromContext(r.Context())
+		}))
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		if entry.incoming != "" {
+			req.Header["X-Request-Id"] = []string{entry.incoming}
+		}
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+
+		if contextID == "" {
+			t.Errorf("%s: no request ID in the context", entry.name)
+		}
+
+		if rr.Header().Get("X-Request-ID") != contextID {
+			t.Errorf("%s: response header set to %s, expected %s", entry.name, rr.Header().Get("X-Request-ID"), contextID)
+		}
+
+		if entry.preserved && contextID != entry.incoming {
+			t.Errorf("%s: request ID set to %s, expected %s", entry.name, contextID, entry.incoming)
+		}
+
+		if !entry.preserved && contextID == entry.incoming {
+			t.Errorf("%s: request ID %q should have been replaced", entry.name, entry.incoming)
+		}
+	}
+
+	if id := RequestIDFromContext(context.Background()); id != "" {
+		t.Errorf("expected no request ID, got %s", id)
+	}
+}
+
+func TestTools_ReadJSONTooLargeReportsSize(t *testing.T) {
+	var testTools Tools
+	testTools.MaxJSONSize = 16
+
+	body := `{"foo": "` + strings.Repeat("x", 40) + `"}`
+
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	var decoded struct {
+		Foo string `json:"foo"`
+	}
+
+	err := testTools.ReadJSON(rr, req, &decoded)
+
+	var tooLarge *BodyTooLargeError
+	if !errors.As(err, &tooLarge) || !errors.Is(err, ErrBodyTooLarge) {
+		t.Fatalf("expected body too large error, got %v", err)
+	}
+
+	if tooLarge.Limit != 16 || tooLarge.Size != int64(len(body)) {
+		t.Errorf("expected a limit of 16 and a size of %d, got %d and %d", len(body), tooLarge.Limit, tooLarge.Size)
+	}
+
+	if expected := fmt.Sprintf("body must not be larger than 16 bytes, but is %d bytes", len(body)); err.Error() != expected {
+		t.Errorf("error message set to %q, expected %q", err.Error(), expected)
+	}
+
+	// without a Content-Length the size is unknown
+	req, _ = http.NewRequest("POST", "/", io.MultiReader(strings.NewReader(body)))
+	req.ContentLength = -1
+
+	err = testTools.ReadJSON(rr, req, &decoded)
+	if !errors.As(err, &tooLarge) || tooLarge.Size != 0 {
+		t.Errorf("unexpected error for a body of unknown length: %v", err)
+	}
+
+	if err != nil && err.Error() != "body must not be larger than 16 bytes" {
+		t.Errorf("unexpected error message for a body of unknown length %q", err.Error())
+	}
+}
+
+func TestTools_UploadFilesStripImageMetadata(t *testing.T) {
+	img, err := os.ReadFile("./testdata/tipfinger.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// insert an APP1 EXIF segment holding a recognizable marker straight after the SOI marker
+	marker := []byte("GPS-LATITUDE-51.5007")
+	exif := append([]byte("Exif\x00\x00"), marker...)
+	segment := append([]byte{0xFF, 0xE1, byte((len(exif) + 2) >> 8), byte(len(exif) + 2)}, exif...)
+	withExif := append(append(append([]byte{}, img[:2]...), segment...), img[2:]...)
+
+	notes := append([]byte("some notes "), marker...)
+
+	var testTools Tools
+	testTools.StripImageMetadata = true
+
+	uploadDir := t.TempDir()
+	request := newUploadRequest(t, []testUpload{
+		{field: "photo", filename: "photo.jpg", content: withExif},
+		{field: "notes", filename: "notes.txt", content: notes},
+	}, nil)
+
+	_, err = testTools.UploadFiles(request, uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := os.ReadFile(filepath.Join(uploadDir, "photo.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(saved, marker) {
+		t.Error("stored image still contains the EXIF metadata")
+	}
+
+	if _, format, err := image.Decode(bytes.NewReader(saved)); err != nil || format != "jpeg" {
+		t.Errorf("stored image is not a valid JPEG: %v", err)
+	}
+
+	savedNotes, err := os.ReadFile(filepath.Join(uploadDir, "notes.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(savedNotes, notes) {
+		t.Error("non-image files should be stored untouched")
+	}
+}
+
+var absoluteURLTests = []struct {
+	name           string
+	target         string
+	remoteAddr     string
+	forwardedProto string
+	forwardedHost  string
+	path           string
+	expectedURL    string
+}{
+	{name: "direct", target: "http://api.example.com/", remoteAddr: "203.0.113.7:5000", path: "/files/1", expectedURL: "http://api.example.com/files/1"},
+	{name: "direct tls", target: "https://api.example.com/", remoteAddr: "203.0.113.7:5000", path: "files/1", expectedURL: "https://api.example.com/files/1"},
+	{name: "spoofed headers", target: "http://api.example.com/", remoteAddr: "203.0.113.7:5000", forwardedProto: "https", forwardedHost: "evil.example.com", path: "/files/1", expectedURL: "http://api.example.com/files/1"},
+	{name: "trusted proxy", target: "http://10.0.0.5:8080/", remoteAddr: "10.0.0.2:5000", forwardedProto: "https", forwardedHost: "www.example.com", path: "/files/1", expectedURL: "https://www.example.com/files/1"},
+	{name: "proxy chain", target: "http://10.0.0.5:8080/", remoteAddr: "10.0.0.2:5000", forwardedProto: "https, http", forwardedHost: "www.example.com, 10.0.0.3", path: "/files/1", expectedURL: "https://www.example.com/files/1"},
+	{name: "invalid forwarded values", target: "http://10.0.0.5:8080/", remoteAddr: "10.0.0.2:5000", forwardedProto: "javascript", forwardedHost: "evil.example.com/path", path: "/files/1", expectedURL: "http://10.0.0.5:8080/files/1"},
+}
+
+func TestTools_AbsoluteURL(t *testing.T) {
+	var testTools Tools
+	trustedProxies := []string{"10.0.0.0/8"}
+
+	for _, entry := range absoluteURLTests {
+		req := httptest.NewRequest("GET", entry.target, nil)
+		req.RemoteAddr = entry.remoteAddr
+		if entry.forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", entry.forwardedProto)
+		}
+		if entry.forwardedHost != "" {
+			req.Header.Set("X-Forwarded-Host", entry.forwardedHost)
+		}
+
+		u := testTools.AbsoluteURL(req, entry.path, trustedProxies)
+		if u != entry.expectedURL {
+			t.Errorf("%s: URL set to %s, expected %s", entry.name, u, entry.expectedURL)
+		}
+	}
+}
+
+func TestTools_ReadJSONLimited(t *testing.T) {
+	var testTools Tools
+	testTools.MaxJSONSize = 32
+
+	body := `{"foo": "` + strings.Repeat("x", 100) + `"}`
+
+	var decoded struct {
+		Foo string `json:"foo"`
+	}
+
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+	err := testTools.ReadJSON(httptest.NewRecorder(), req, &decoded)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("expected the default limit to reject the body, got %v", err)
+	}
+
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(body))
+	err = testTools.ReadJSONLimited(httptest.NewRecorder(), req, &decoded, 1024)
+	if err != nil {
+		t.Errorf("error not expected with a larger limit, but received - %s", err.Error())
+	}
+
+	if decoded.Foo != strings.Repeat("x", 100) {
+		t.Error("body was not decoded")
+	}
+
+	req, _ = http.NewRequest("POST", "/", strings.NewReader(body))
+	err = testTools.ReadJSONLimited(httptest.NewRecorder(), req, &decoded, 16)
+	if !errors.Is(err, ErrBodyTooLarge) {
+		t.Errorf("expected a smaller limit to reject the body, got %v", err)
+	}
+}
+
+func TestUploadErrors(t *testing.T) {
+	pathErr := &fs.PathError{Op: "open", Path: "avatar.png", Err: fs.ErrPermission}
+	err := error(UploadErrors{errors.New("files of type 'text/plain' are not allowed"), fmt.Errorf("saving avatar.png: %w", pathErr)})
+
+	if !errors.Is(err, fs.ErrPermission) {
+		t.Error("errors.Is should find a sentinel wrapped by one of the upload errors")
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Error("errors.Is matched a sentinel that none of the upload errors wrap")
+	}
+
+	var target *fs.PathError
+	if !errors.As(err, &target) || target.Path != "avatar.png" {
+		t.Errorf("errors.As should find the wrapped *fs.PathError, got %v", target)
+	}
+
+	if !strings.HasPrefix(err.Error(), "2 files failed to upload: ") {
+		t.Errorf("unexpected error message %q", err.Error())
+	}
+}
+
+func TestTools_UploadFilesConcurrently(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var uploads []testUpload
+	for i := 0; i < 8; i++ {
+		uploads = append(uploads, testUpload{field: "file", filename: fmt.Sprintf("img%d.png", i), content: img})
+	}
+	uploads[5].filename = "notes.txt"
+	uploads[5].content = []byte("not an image")
+
+	testTools := Tools{UploadConcurrency: 3, AllowedFileTypes: []string{"image/png"}}
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, uploads, nil), uploadDir, false)
+
+	var uploadErrs UploadErrors
+	if !errors.As(err, &uploadErrs) {
+		t.Fatalf("expected UploadErrors, got %v", err)
+	}
+
+	if len(uploadErrs.Errors()) != 1 {
+		t.Errorf("expected 1 upload error, got %d", len(uploadErrs.Errors()))
+	}
+
+	if len(files) != 7 {
+		t.Fatalf("expected 7 files to be uploaded, got %d", len(files))
+	}
+
+	expected := []string{"img0.png", "img1.png", "img2.png", "img3.png", "img4.png", "img6.png", "img7.png"}
+	for i, file := range files {
+		if file.OriginalFileName != expected[i] {
+			t.Errorf("file %d: expected %s, got %s", i, expected[i], file.OriginalFileName)
+		}
+
+		if _, err := os.Stat(filepath.Join(uploadDir, file.NewFileName)); os.IsNotExist(err) {
+			t.Errorf("expected file to exist: %s", err.Error())
+		}
+	}
+}
+
+func BenchmarkTools_UploadFiles(b *testing.B) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var uploads []testUpload
+	for i := 0; i < 16; i++ {
+		uploads = append(uploads, testUpload{field: "file", filename: fmt.Sprintf("img%d.png", i), content: img})
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		b.Run(fmt.Sprintf("concurrency %d", concurrency), func(b *testing.B) {
+			testTools := Tools{UploadConcurrency: concurrency, FullyDecodeImages: true}
+			uploadDir := b.TempDir()
+
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				request := newUploadRequest(b, uploads, nil)
+				b.StartTimer()
+
+				if _, err := testTools.UploadFiles(request, uploadDir); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestTools_ReadJSONWithBOM(t *testing.T) {
+	for _, maxDepth := range []int{0, 4} {
+		testTools := Tools{MaxJSONDepth: maxDepth}
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader("\xef\xbb\xbf{\"foo\": \"bar\"}"))
+
+		err := testTools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON)
+		if err != nil {
+			t.Fatalf("max depth %d: error not expected, but received - %s", maxDepth, err.Error())
+		}
+
+		if decodedJSON.Foo != "bar" {
+			t.Errorf("max depth %d: expected foo to be bar, got %q", maxDepth, decodedJSON.Foo)
+		}
+	}
+}
+
+var bearerTokenTests = []struct {
+	name          string
+	header        string
+	token         string
+	expectedError error
+}{
+	{name: "valid", header: "Bearer abc.def-123", token: "abc.def-123"},
+	{name: "lower case scheme with padding", header: "bearer   abc123  ", token: "abc123"},
+	{name: "missing header", expectedError: ErrMissingAuthorization},
+	{name: "basic scheme", header: "Basic dXNlcjpwYXNz", expectedError: ErrInvalidAuthorization},
+	{name: "empty token", header: "Bearer ", expectedError: ErrInvalidAuthorization},
+	{name: "no scheme", header: "abc123", expectedError: ErrInvalidAuthorization},
+	{name: "several tokens", header: "Bearer abc 123", expectedError: ErrInvalidAuthorization},
+}
+
+func TestTools_BearerToken(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range bearerTokenTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if entry.header != "" {
+			req.Header.Set("Authorization", entry.header)
+		}
+
+		token, err := testTools.BearerToken(req)
+
+		if entry.expectedError != nil {
+			if !errors.Is(err, entry.expectedError) {
+				t.Errorf("%s: expected error %v, got %v", entry.name, entry.expectedError, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		if token != entry.token {
+			t.Errorf("%s: expected token %q, got %q", entry.name, entry.token, token)
+		}
+	}
+}
+
+func TestTools_UploadFilesProgress(t *testing.T) {
+	content := bytes.Repeat([]byte("progress "), 20000)
+
+	var counts []int64
+	var total int64
+	testTools := Tools{ProgressFunc: func(filename string, bytesWritten, totalBytes int64) {
+		if filename != "big.txt" {
+			t.Errorf("expected progress for big.txt, got %s", filename)
+		}
+		counts = append(counts, bytesWritten)
+		total = totalBytes
+	}}
+
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "big.txt", content: content}}, nil)
+
+	_, err := testTools.UploadFiles(request, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(counts) < 2 {
+		t.Fatalf("expected progress to be reported several times, got %d", len(counts))
+	}
+
+	for i := 1; i < len(counts); i++ {
+		if counts[i] <= counts[i-1] {
+			t.Errorf("expected increasing byte counts, got %d after %d", counts[i], counts[i-1])
+		}
+	}
+
+	if last := counts[len(counts)-1]; last != int64(len(content)) || total != int64(len(content)) {
+		t.Errorf("expected progress to end at %d of %d bytes, got %d of %d", len(content), len(content), last, total)
+	}
+
+	// a re-encoded image reports progress against the size of the image that is saved
+	img, err := os.ReadFile("./testdata/tipfinger.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts = nil
+	testTools.StripImageMetadata = true
+	uploadDir := t.TempDir()
+
+	request = newUploadRequest(t, []testUpload{{field: "file", filename: "big.txt", content: img}}, nil)
+
+	_, err = testTools.UploadFiles(request, uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved, err := os.ReadFile(filepath.Join(uploadDir, "big.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if last := counts[len(counts)-1]; last != int64(len(saved)) || total != int64(len(saved)) {
+		t.Errorf("expected progress to end at %d of %d bytes, got %d of %d", len(saved), len(saved), last, total)
+	}
+}
+
+var validateConfigTests = []struct {
+	name          string
+	allowed       []string
+	disallowed    []string
+	errorExpected bool
+}{
+	{name: "empty"},
+	{name: "exact and category", allowed: []string{"image/jpeg", " Image/PNG ", "text/*"}, disallowed: []string{"image/svg+xml"}},
+	{name: "with parameters", allowed: []string{"text/plain; charset=utf-8"}},
+	{name: "missing category", allowed: []string{"image/png", "jpeg"}, errorExpected: true},
+	{name: "bad disallowed type", disallowed: []string{"svg"}, errorExpected: true},
+	{name: "empty subtype", allowed: []string{"image/"}, errorExpected: true},
+	{name: "wildcard category", allowed: []string{"*/*"}, errorExpected: true},
+}
+
+func TestTools_ValidateConfig(t *testing.T) {
+	for _, entry := range validateConfigTests {
+		testTools := Tools{AllowedFileTypes: entry.allowed, DisallowedFileTypes: entry.disallowed}
+
+		err := testTools.ValidateConfig()
+
+		if entry.errorExpected && !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("%s: expected ErrInvalidConfig, got %v", entry.name, err)
+		}
+
+		if !entry.errorExpected && err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+	}
+}
+
+func TestTools_UploadFilesInvalidConfig(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTools := Tools{AllowedFileTypes: []string{"jpeg"}}
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "img.png", content: img}}, nil)
+
+	_, err = testTools.UploadFiles(request, t.TempDir())
+
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a *ConfigError, got %v", err)
+	}
+
+	if configErr.Field != "AllowedFileTypes" || configErr.Value != "jpeg" {
+		t.Errorf("expected the error to name AllowedFileTypes entry jpeg, got %s", err.Error())
+	}
+}
+
+func TestTools_WriteCSV(t *testing.T) {
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	err := testTools.WriteCSV(rr, "report.csv", []string{"name", "notes"}, [][]string{
+		{"Alice", "likes tea, coffee"},
+		{"Bob", `said "hi"`},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ct := rr.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("wrong content type: %s", ct)
+	}
+
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename="report.csv"` {
+		t.Errorf("wrong content disposition: %s", cd)
+	}
+
+	expected := "name,notes\nAlice,\"likes tea, coffee\"\nBob,\"said \"\"hi\"\"\"\n"
+	if rr.Body.String() != expected {
+		t.Errorf("expected %q, got %q", expected, rr.Body.String())
+	}
+}
+
+func TestTools_WriteCSVStream(t *testing.T) {
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	rows := make(chan []string)
+	go func() {
+		defer close(rows)
+		for i := 0; i < 250; i++ {
+			rows <- []string{strconv.Itoa(i), "line one\nline two"}
+		}
+	}()
+
+	err := testTools.WriteCSVStream(rr, "export.csv", []string{"id", "text"}, rows)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := csv.NewReader(rr.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(records) != 251 {
+		t.Fatalf("expected 251 records, got %d", len(records))
+	}
+
+	if records[250][0] != "249" || records[250][1] != "line one\nline two" {
+		t.Errorf("wrong last record: %v", records[250])
+	}
+}
+
+func TestTools_PushJSONToRemoteWithOptions(t *testing.T) {
+	var keys, bodies []string
+
+	client := MockTestClient(func(req *http.Request) *http.Response {
+		keys = append(keys, req.Header.Get("Idempotency-Key"))
+		b, _ := io.ReadAll(req.Body)
+		bodies = append(bodies, string(b))
+
+		status := http.StatusServiceUnavailable
+		if len(keys) == 3 {
+			status = http.StatusCreated
+		}
+
+		return &http.Response{
+			StatusCode: status,
+			Body:       io.NopCloser(bytes.NewBufferString("ok")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var testTools Tools
+
+	_, status, err := testTools.PushJSONToRemoteWithOptions("http://example.net", map[string]string{"foo": "bar"}, PushOptions{Retries: 3}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != http.StatusCreated {
+		t.Errorf("status set to %d, expected %d", status, http.StatusCreated)
+	}
+
+	if len(keys) != 3 {
+		t.Fatalf("expected 3 attempts, got %d", len(keys))
+	}
+
+	for i := range keys {
+		if keys[i] == "" || keys[i] != keys[0] {
+			t.Errorf("attempt %d: expected idempotency key %q, got %q", i, keys[0], keys[i])
+		}
+
+		if bodies[i] != `{"foo":"bar"}` {
+			t.Errorf("attempt %d: body set to %s", i, bodies[i])
+		}
+	}
+
+	keys, bodies = nil, nil
+
+	_, _, err = testTools.PushJSONToRemoteWithOptions("http://example.net", nil, PushOptions{IdempotencyKey: "order-42"}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(keys) != 1 || keys[0] != "order-42" {
+		t.Errorf("expected a single attempt with the supplied key, got %v", keys)
+	}
+}
+
+var flexTimeTests = []struct {
+	name          string
+	json          string
+	expected      time.Time
+	errorExpected bool
+}{
+	{name: "space separated", json: `"2024-06-12 15:04:05"`, expected: time.Date(2024, 6, 12, 15, 4, 5, 0, time.UTC)},
+	{name: "rfc3339", json: `"2024-06-12T15:04:05Z"`, expected: time.Date(2024, 6, 12, 15, 4, 5, 0, time.UTC)},
+	{name: "no zone", json: `"2024-06-12T15:04:05"`, expected: time.Date(2024, 6, 12, 15, 4, 5, 0, time.UTC)},
+	{name: "date only", json: `"2024-06-12"`, expected: time.Date(2024, 6, 12, 0, 0, 0, 0, time.UTC)},
+	{name: "null", json: `null`},
+	{name: "unrecognized", json: `"12/06/2024"`, errorExpected: true},
+	{name: "number", json: `1718204645`, errorExpected: true},
+}
+
+func TestTools_FlexTime(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range flexTimeTests {
+		var payload struct {
+			CreatedAt FlexTime `json:"created_at"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(`{"created_at": `+entry.json+`}`))
+		err := testTools.ReadJSON(httptest.NewRecorder(), req, &payload)
+
+		if entry.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", entry.name)
+		}
+
+		if !entry.errorExpected && err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		if !entry.errorExpected && !payload.CreatedAt.Equal(entry.expected) {
+			t.Errorf("%s: expected %s, got %s", entry.name, entry.expected, payload.CreatedAt.Time)
+		}
+	}
+}
+
+func TestTools_UploadFilesMaxTotalSize(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 10000)
+	uploads := []testUpload{
+		{field: "file", filename: "one.txt", content: content},
+		{field: "file", filename: "two.txt", content: content},
+		{field: "other", filename: "three.txt", content: content},
+	}
+
+	testTools := Tools{MaxTotalUploadSize: 25000}
+	uploadDir := t.TempDir()
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, uploads, nil), uploadDir)
+	if err == nil {
+		t.Fatal("expected uploads over the total size limit to be rejected")
+	}
+
+	if len(files) != 0 {
+		t.Errorf("expected no files to be uploaded, got %d", len(files))
+	}
+
+	entries, err := os.ReadDir(uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(entries) != 0 {
+		t.Errorf("expected the upload directory to be empty, found %d entries", len(entries))
+	}
+
+	testTools.MaxTotalUploadSize = 30000
+
+	files, err = testTools.UploadFiles(newUploadRequest(t, uploads, nil), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 3 {
+		t.Errorf("expected 3 files to be uploaded, got %d", len(files))
+	}
+
+	// only the files of the chosen field count towards the limit
+	testTools.MaxTotalUploadSize = 15000
+
+	files, err = testTools.UploadFilesFromField(newUploadRequest(t, uploads, nil), "other", t.TempDir())
+	if err != nil {
+		t.Errorf("single field under the limit: error not expected, but received - %s", err.Error())
+	}
+
+	if len(files) != 1 {
+		t.Errorf("expected 1 file to be uploaded from the field, got %d", len(files))
+	}
+
+	if _, err = testTools.UploadFilesFromField(newUploadRequest(t, uploads, nil), "file", t.TempDir()); err == nil {
+		t.Error("single field over the limit: error expected, but none received")
+	}
+}
+
+// recordingMetrics keeps every response observed through the Metrics interface
+type recordingMetrics struct {
+	statuses []int
+	sizes    []int
+}
+
+func (m *recordingMetrics) ObserveResponse(status int, size int, dur time.Duration) {
+	m.statuses = append(m.statuses, status)
+	m.sizes = append(m.sizes, size)
+}
+
+func TestTools_WriteJSONMetrics(t *testing.T) {
+	metrics := &recordingMetrics{}
+	testTools := Tools{Metrics: metrics}
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSON(rr, http.StatusCreated, map[string]string{"foo": "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr2 := httptest.NewRecorder()
+	err = testTools.ErrorJSON(rr2, errors.New("nope"), http.StatusNotFound)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(metrics.statuses) != 2 {
+		t.Fatalf("expected 2 responses to be observed, got %d", len(metrics.statuses))
+	}
+
+	if metrics.statuses[0] != http.StatusCreated || metrics.sizes[0] != rr.Body.Len() {
+		t.Errorf("expected status %d and size %d, got %d and %d", http.StatusCreated, rr.Body.Len(), metrics.statuses[0], metrics.sizes[0])
+	}
+
+	if metrics.statuses[1] != http.StatusNotFound || metrics.sizes[1] != rr2.Body.Len() {
+		t.Errorf("expected status %d and size %d, got %d and %d", http.StatusNotFound, rr2.Body.Len(), metrics.statuses[1], metrics.sizes[1])
+	}
+}
+
+func TestTools_ReadJSONEach(t *testing.T) {
+	// the limits apply to each element, so they do not restrict how long the array may be
+	testTools := Tools{MaxJSONSize: 64, MaxJSONDepth: 1}
+
+	var body strings.Builder
+	body.WriteString("[")
+	for i := 0; i < 10000; i++ {
+		if i > 0 {
+			body.WriteString(",")
+		}
+		fmt.Fprintf(&body, `{"id": %d}`, i)
+	}
+	body.WriteString("]")
+
+	var item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	count, sum := 0, 0
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body.String()))
+	err := testTools.ReadJSONEach(httptest.NewRecorder(), req, &item, func() error {
+		count++
+		sum += item.ID
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if count != 10000 || sum != 9999*10000/2 {
+		t.Errorf("expected 10000 elements summing to %d, got %d summing to %d", 9999*10000/2, count, sum)
+	}
+}
+
+var readJSONEachErrorTests = []struct {
+	name          string
+	json          string
+	expectedError error
+}{
+	{name: "not an array", json: `{"id": 1}`, expectedError: ErrIncorrectJSONType},
+	{name: "empty", json: ``, expectedError: ErrEmptyBody},
+	{name: "malformed element", json: `[{"id": 1}, {"id": }]`, expectedError: ErrBadlyFormedJSON},
+	{name: "truncated", json: `[{"id": 1}, {"id": 2}`, expectedError: ErrBadlyFormedJSON},
+	{name: "unknown field", json: `[{"id": 1, "extra": true}]`, expectedError: ErrUnknownField},
+	{name: "trailing payload", json: `[{"id": 1}] [{"id": 2}]`, expectedError: ErrMultiplePayloads},
+	{name: "too large", json: `[{"id": 1}, {"id": 2}, {"id": 3}, {"id": 4}, {"id": 5}, {"id": 6}]`, expectedError: ErrBodyTooLarge},
+	{name: "element too large", json: `[{"id":                              1}]`, expectedError: ErrBodyTooLarge},
+	{name: "element too deep", json: `[{"id": [1]}]`, expectedError: ErrJSONTooDeep},
+}
+
+func TestTools_ReadJSONEachErrors(t *testing.T) {
+	testTools := Tools{MaxJSONSize: 24, MaxJSONStreamSize: 64, MaxJSONDepth: 1}
+
+	for _, entry := range readJSONEachErrorTests {
+		var item struct {
+			ID int `json:"id"`
+		}
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(entry.json))
+		err := testTools.ReadJSONEach(httptest.NewRecorder(), req, &item, func() error { return nil })
+
+		if !errors.Is(err, entry.expectedError) {
+			t.Errorf("%s: expected error %v, got %v", entry.name, entry.expectedError, err)
+		}
+	}
+
+	stop := errors.New("stop")
+	calls := 0
+	var item struct {
+		ID int `json:"id"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`[{"id": 1}, {"id": 2}, {"id": 3}]`))
+	err := testTools.ReadJSONEach(httptest.NewRecorder(), req, &item, func() error {
+		calls++
+		if item.ID == 2 {
+			return stop
+		}
+		return nil
+	})
+
+	if err != stop || calls != 2 {
+		t.Errorf("expected the callback error after 2 calls, got %v after %d", err, calls)
+	}
+}
+
+var readJSONEachLimitTests = []struct {
+	name          string
+	json          string
+	maxSize       int
+	expectedCount int
+	errorExpected bool
+}{
+	{name: "element at the limit", json: `["abcdefgh","x","y"]`, maxSize: 10, expectedCount: 3},
+	{name: "element under the limit", json: `["abcdefgh","x","y"]`, maxSize: 11, expectedCount: 3},
+	{name: "number at the limit", json: `[123,4]`, maxSize: 3, expectedCount: 2},
+	{name: "number under the limit", json: `[123,4]`, maxSize: 4, expectedCount: 2},
+	{name: "element over the limit", json: `["x","abcdefgh","y"]`, maxSize: 9, expectedCount: 1, errorExpected: true},
+	{name: "element far over the limit", json: `["` + strings.Repeat("a", 10000) + `"]`, maxSize: 10, errorExpected: true},
+}
+
+func TestTools_ReadJSONEachLimits(t *testing.T) {
+	for _, entry := range readJSONEachLimitTests {
+		testTools := Tools{MaxJSONSize: entry.maxSize}
+
+		var item interface{}
+		count := 0
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(entry.json))
+		err := testTools.ReadJSONEach(httptest.NewRecorder(), req, &item, func() error {
+			count++
+			return nil
+		})
+
+		if entry.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", entry.name)
+		}
+
+		if !entry.errorExpected && err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		var tooLarge *BodyTooLargeError
+		if entry.errorExpected && (!errors.As(err, &tooLarge) || tooLarge.Limit != entry.maxSize) {
+			t.Errorf("%s: expected a BodyTooLargeError with a limit of %d, got %v", entry.name, entry.maxSize, err)
+		}
+
+		if count != entry.expectedCount {
+			t.Errorf("%s: expected %d elements, got %d", entry.name, entry.expectedCount, count)
+		}
+	}
+}
+
+func TestTools_ParseDataURI(t *testing.T) {
+	var testTools Tools
+
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mimeType, data, err := testTools.ParseDataURI("data:image/png;base64," + base64.StdEncoding.EncodeToString(img))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mimeType != "image/png" {
+		t.Errorf("expected image/png, got %s", mimeType)
+	}
+
+	if !bytes.Equal(data, img) {
+		t.Error("decoded data does not match the original image")
+	}
+
+	mimeType, _, err = testTools.ParseDataURI("data:;base64,aGk=")
+	if err != nil || mimeType != "text/plain;charset=US-ASCII" {
+		t.Errorf("expected the default type, got %s and %v", mimeType, err)
+	}
+
+	for _, uri := range []string{
+		"image/png;base64,aGk=",
+		"data:image/png,hello",
+		"data:image/png;base64",
+		"data:image/png;base64,not*base64",
+	} {
+		if _, _, err := testTools.ParseDataURI(uri); err == nil {
+			t.Errorf("%s: error expected, but none received", uri)
+		}
+	}
+}
+
+func TestTools_WriteCreated(t *testing.T) {
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	err := testTools.WriteCreated(rr, "/widgets/42", map[string]int{"id": 42})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected status %d, got %d", http.StatusCreated, rr.Code)
+	}
+
+	if location := rr.Header().Get("Location"); location != "/widgets/42" {
+		t.Errorf("expected Location /widgets/42, got %s", location)
+	}
+
+	if rr.Body.String() != `{"id":42}` {
+		t.Errorf("wrong body: %s", rr.Body.String())
+	}
+}
+
+func TestTools_PushJSONToRemoteRedirect(t *testing.T) {
+	var bodies []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(b))
+
+		if r.URL.Path == "/old" {
+			http.Redirect(w, r, "/new", http.StatusTemporaryRedirect)
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var testTools Tools
+	data := map[string]string{"foo": "bar"}
+
+	_, status, err := testTools.PushJSONToRemote(server.URL+"/old", data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = testTools.PushJSONToRemoteWithOptions(server.URL+"/old", data, PushOptions{Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf("expected status %d after the redirect, got %d", http.StatusOK, status)
+	}
+
+	if len(bodies) != 4 {
+		t.Fatalf("expected 4 requests, got %d", len(bodies))
+	}
+
+	for i, body := range bodies {
+		if body != `{"foo":"bar"}` {
+			t.Errorf("request %d: body set to %q", i, body)
+		}
+	}
+}
+
+var imageConstraintsTests = []struct {
+	name          string
+	constraints   ImageConstraints
+	errorExpected bool
+}{
+	{name: "within bounds", constraints: ImageConstraints{MinWidth: 100, MinHeight: 100, MaxWidth: 400, MaxHeight: 400, RequireSquare: true}},
+	{name: "too narrow", constraints: ImageConstraints{MinWidth: 500}, errorExpected: true},
+	{name: "too short", constraints: ImageConstraints{MinHeight: 401}, errorExpected: true},
+	{name: "too wide", constraints: ImageConstraints{MaxWidth: 300}, errorExpected: true},
+	{name: "too tall", constraints: ImageConstraints{MaxHeight: 399}, errorExpected: true},
+}
+
+func TestTools_UploadFilesImageConstraints(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range imageConstraintsTests {
+		testTools := Tools{ImageConstraints: entry.constraints}
+		uploadDir := t.TempDir()
+
+		request := newUploadRequest(t, []testUpload{{field: "file", filename: "img.png", content: img}}, nil)
+		_, err := testTools.UploadFiles(request, uploadDir)
+
+		if entry.errorExpected && err == nil {
+			t.Errorf("%s: error expected, but none received", entry.name)
+		}
+
+		if !entry.errorExpected && err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+		}
+
+		entries, _ := os.ReadDir(uploadDir)
+		if entry.errorExpected && len(entries) != 0 {
+			t.Errorf("%s: expected the rejected image not to be saved", entry.name)
+		}
+	}
+
+	testTools := Tools{ImageConstraints: ImageConstraints{RequireSquare: true}}
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "notes.txt", content: []byte("not an image")}}, nil)
+	if _, err := testTools.UploadFiles(request, t.TempDir()); err != nil {
+		t.Errorf("files that are not images should not be checked, but received - %s", err.Error())
+	}
+}
+
+var mergePatchTests = []struct {
+	name     string
+	original string
+	patch    string
+	expected string
+}{
+	{name: "add key", original: `{"a":"b"}`, patch: `{"c":"d"}`, expected: `{"a":"b","c":"d"}`},
+	{name: "replace value", original: `{"a":"b"}`, patch: `{"a":"c"}`, expected: `{"a":"c"}`},
+	{name: "delete key", original: `{"a":"b","b":"c"}`, patch: `{"a":null}`, expected: `{"b":"c"}`},
+	{name: "recursive merge", original: `{"a":{"b":"c","d":"e"}}`, patch: `{"a":{"b":"x","d":null,"f":1.50}}`, expected: `{"a":{"b":"x","f":1.50}}`},
+	{name: "array replaces", original: `{"a":[{"b":"c"}]}`, patch: `{"a":[1]}`, expected: `{"a":[1]}`},
+	{name: "object replaces scalar", original: `{"a":"foo"}`, patch: `{"a":{"b":null,"c":"<d>"}}`, expected: `{"a":{"c":"<d>"}}`},
+	{name: "non-object patch", original: `{"a":"foo"}`, patch: `["c"]`, expected: `["c"]`},
+	{name: "null patch", original: `{"a":"foo"}`, patch: `null`, expected: `null`},
+	{name: "object patch on array", original: `["a"]`, patch: `{"a":"b"}`, expected: `{"a":"b"}`},
+}
+
+func TestTools_ApplyMergePatch(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range mergePatchTests {
+		result, err := testTools.ApplyMergePatch([]byte(entry.original), []byte(entry.patch))
+		if err != nil {
+			t.Errorf("%s: error not expected, but received - %s", entry.name, err.Error())
+			continue
+		}
+
+		if string(result) != entry.expected {
+			t.Errorf("%s: expected %s, got %s", entry.name, entry.expected, result)
+		}
+	}
+
+	if _, err := testTools.ApplyMergePatch([]byte(`{"a":`), []byte(`{}`)); err == nil {
+		t.Error("invalid original: error expected, but none received")
+	}
+
+	if _, err := testTools.ApplyMergePatch([]byte(`{}`), []byte(`{} {}`)); err == nil {
+		t.Error("invalid patch: error expected, but none received")
+	}
+}
+
+func TestTools_ReadJSONAllowUnknown(t *testing.T) {
+	var testTools Tools
+	body := `{"foo": "bar", "extra": true}`
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err := testTools.ReadJSONAllowUnknown(httptest.NewRecorder(), req, &decodedJSON)
+	if err != nil {
+		t.Fatalf("error not expected, but received - %s", err.Error())
+	}
+
+	if decodedJSON.Foo != "bar" {
+		t.Errorf("expected foo to be bar, got %q", decodedJSON.Foo)
+	}
+
+	req = httptest.NewRequest("POST", "/", strings.NewReader(body))
+	err = testTools.ReadJSON(httptest.NewRecorder(), req, &decodedJSON)
+	if !errors.Is(err, ErrUnknownField) {
+		t.Errorf("expected ReadJSON to reject the unknown field, got %v", err)
+	}
+
+	if testTools.AllowUnknownFields {
+		t.Error("ReadJSONAllowUnknown should not change AllowUnknownFields")
+	}
+}
+
+func TestTools_UploadFilesDurable(t *testing.T) {
+	var synced []string
+
+	var testTools Tools
+	testTools.uploadSync = func(f *os.File) error {
+		synced = append(synced, f.Name())
+		return f.Sync()
+	}
+
+	uploadDir := t.TempDir()
+	request := newUploadRequest(t, []testUpload{{field: "file", filename: "ledger.txt", content: []byte("balance: 42")}}, nil)
+
+	if _, err := testTools.UploadFiles(request, uploadDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(synced) != 0 {
+		t.Fatalf("expected no syncs without DurableUploads, got %v", synced)
+	}
+
+	testTools.DurableUploads = true
+	request = newUploadRequest(t, []testUpload{{field: "file", filename: "journal.txt", content: []byte("balance: 42")}}, nil)
+	if _, err := testTools.UploadFiles(request, uploadDir, false); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{filepath.Join(uploadDir, "journal.txt")}
+	if runtime.GOOS != "windows" {
+		expected = append(expected, uploadDir)
+	}
+
+	if !reflect.DeepEqual(synced, expected) {
+		t.Errorf("expected %v to be synced, got %v", expected, synced)
+	}
+
+	// a file that cannot be synced is removed rather than left looking complete
+	testTools.uploadSync = func(f *os.File) error {
+		return errors.New("disk unavailable")
+	}
+
+	request = newUploadRequest(t, []testUpload{{field: "file", filename: "failed.txt", content: []byte("balance: 42")}}, nil)
+	if _, err := testTools.UploadFiles(request, uploadDir, false); err == nil {
+		t.Error("expected the sync failure to be returned")
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "failed.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the unsynced file to be removed, got %v", err)
+	}
+}
+
+func TestTools_WriteUploadedFileRemovesPartialFile(t *testing.T) {
+	var testTools Tools
+	uploadDir := t.TempDir()
+
+	src := io.MultiReader(strings.NewReader("the first half"), iotest.ErrReader(errors.New("connection reset")))
+
+	if _, err := testTools.writeUploadedFile(src, uploadDir, "partial.txt", "text/plain", false); err == nil {
+		t.Error("expected the read failure to be returned")
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "partial.txt")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected the partial file to be removed, got %v", err)
+	}
+}
+
+var wantsJSONTests = []struct {
+	name     string
+	path     string
+	headers  map[string]string
+	expected bool
+}{
+	{name: "accept json", path: "/widgets", headers: map[string]string{"Accept": "application/json"}, expected: true},
+	{name: "accept json among others", path: "/widgets", headers: map[string]string{"Accept": "text/html;q=0.9, application/json;q=0.8"}, expected: true},
+	{name: "accept problem json", path: "/widgets", headers: map[string]string{"Accept": "application/problem+json"}, expected: true},
+	{name: "json refused", path: "/widgets", headers: map[string]string{"Accept": "application/json;q=0"}},
+	{name: ".json suffix", path: "/widgets/42.JSON", expected: true},
+	{name: "xhr", path: "/widgets", headers: map[string]string{"X-Requested-With": "XMLHttpRequest"}, expected: true},
+	{name: "browser", path: "/widgets", headers: map[string]string{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8"}},
+	{name: "wildcard only", path: "/widgets", headers: map[string]string{"Accept": "*/*"}},
+	{name: "no signals", path: "/widgets"},
+}
+
+func TestTools_WantsJSON(t *testing.T) {
+	var testTools Tools
+
+	for _, entry := range wantsJSONTests {
+		req := httptest.NewRequest("GET", entry.path, nil)
+		for key, value := range entry.headers {
+			req.Header.Set(key, value)
+		}
+
+		if got := testTools.WantsJSON(req); got != entry.expected {
+			t.Errorf("%s: expected %t, got %t", entry.name, entry.expected, got)
+		}
+	}
+}
+
+func TestTools_ResumableUpload(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.ResumableUploadDir = t.TempDir()
+	uploadDir := t.TempDir()
+
+	id, err := testTools.CreateUpload(uploadDir, int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	half := len(img) / 2
+
+	offset, err := testTools.AppendChunk(id, 0, bytes.NewReader(img[:half]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset != int64(half) {
+		t.Errorf("expected offset %d after the first chunk, got %d", half, offset)
+	}
+
+	// resending the first chunk is refused
+	if _, err = testTools.AppendChunk(id, 0, bytes.NewReader(img[:half])); !errors.Is(err, ErrOffsetMismatch) {
+		t.Errorf("expected ErrOffsetMismatch, got %v", err)
+	}
+
+	// the upload is found again from its metadata, as it would be after a restart
+	restarted := Tools{ResumableUploadDir: testTools.ResumableUploadDir}
+
+	current, total, err := restarted.HeadUpload(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if current != int64(half) || total != int64(len(img)) {
+		t.Errorf("expected %d of %d bytes, got %d of %d", half, len(img), current, total)
+	}
+
+	// a chunk running past the end is discarded, even when it is read a byte at a time
+	tooLong := append(append([]byte{}, img[half:]...), 'x')
+	if _, err = restarted.AppendChunk(id, current, iotest.OneByteReader(bytes.NewReader(tooLong))); err == nil {
+		t.Error("expected a chunk past the end of the upload to be rejected")
+	}
+
+	offset, file, err := restarted.AppendChunkFile(id, current, bytes.NewReader(img[half:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if offset != int64(len(img)) {
+		t.Errorf("expected offset %d after the last chunk, got %d", len(img), offset)
+	}
+
+	if file == nil || file.NewFileName != id+".png" || file.FileSize != int64(len(img)) {
+		t.Fatalf("unexpected completed file %+v", file)
+	}
+
+	assembled, err := os.ReadFile(filepath.Join(uploadDir, file.NewFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(assembled, img) {
+		t.Error("assembled file does not match the original")
+	}
+
+	// a completed upload leaves nothing else behind
+	if _, _, err = testTools.HeadUpload(id); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("expected ErrUploadNotFound for a completed upload, got %v", err)
+	}
+
+	if _, err = os.Stat(filepath.Join(testTools.ResumableUploadDir, id+".json")); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("expected the metadata of the completed upload to be removed")
+	}
+
+	for _, unknown := range []string{"unknown", "../" + id, ""} {
+		if _, _, err = testTools.HeadUpload(unknown); !errors.Is(err, ErrUploadNotFound) {
+			t.Errorf("%q: expected ErrUploadNotFound, got %v", unknown, err)
+		}
+	}
+}
+
+func TestTools_ResumableUploadFileTypes(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.ResumableUploadDir = t.TempDir()
+	testTools.AllowedFileTypes = []string{"image/jpeg"}
+	uploadDir := t.TempDir()
+
+	id, err := testTools.CreateUpload(uploadDir, int64(len(img)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first chunk is enough to refuse the upload
+	offset, err := testTools.AppendChunk(id, 0, bytes.NewReader(img[:1024]))
+	if err == nil {
+		t.Error("disallowed type: error expected, but none received")
+	}
+
+	if offset != 0 {
+		t.Errorf("disallowed type: expected nothing to be stored, got offset %d", offset)
+	}
+}
+
+func TestTools_ResumableUploadExpires(t *testing.T) {
+	var testTools Tools
+	testTools.ResumableUploadDir = t.TempDir()
+	testTools.ResumableUploadTTL = time.Hour
+	uploadDir := t.TempDir()
+
+	stale, err := testTools.CreateUpload(uploadDir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partial := filepath.Join(uploadDir, stale+".part")
+	past := time.Now().Add(-2 * time.Hour)
+	if err = os.Chtimes(partial, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	// creating another upload sweeps away the stale one
+	if _, err = testTools.CreateUpload(uploadDir, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(partial); !errors.Is(err, fs.ErrNotExist) {
+		t.Error("expected the partial file of the stale upload to be removed")
+	}
+
+	if _, _, err = testTools.HeadUpload(stale); !errors.Is(err, ErrUploadNotFound) {
+		t.Errorf("expected ErrUploadNotFound for an expired upload, got %v", err)
+	}
+
+	// an upload is kept for the TTL it was created with, even by Tools sharing the directory with a shorter one
+	longLived := Tools{ResumableUploadDir: testTools.ResumableUploadDir, ResumableUploadTTL: 7 * 24 * time.Hour}
+
+	kept, err := longLived.CreateUpload(uploadDir, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	partial = filepath.Join(uploadDir, kept+".part")
+	if err = os.Chtimes(partial, past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = testTools.CreateUpload(uploadDir, 10); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = testTools.HeadUpload(kept); err != nil {
+		t.Errorf("expected an upload created with a longer TTL to be kept, got %v", err)
+	}
+}
+
+// panickingPayload is a value whose MarshalJSON method panics
+type panickingPayload struct{}
+
+func (p panickingPayload) MarshalJSON() ([]byte, error) {
+	panic("cannot marshal")
+}
+
+func TestTools_WriteJSONRecoversPanic(t *testing.T) {
+	var testTools Tools
+	rr := httptest.NewRecorder()
+
+	err := testTools.WriteJSON(rr, http.StatusOK, map[string]interface{}{"bad": panickingPayload{}})
+	if err == nil {
+		t.Fatal("error expected, but none received")
+	}
+
+	if !strings.Contains(err.Error(), "cannot marshal") {
+		t.Errorf("expected the error to describe the panic, got %s", err.Error())
+	}
+
+	if rr.Body.Len() != 0 {
+		t.Errorf("expected nothing to be written, got %s", rr.Body.String())
+	}
+
+	payload := make(chan interface{}, 1)
+	payload <- panickingPayload{}
+	close(payload)
+
+	if err = testTools.WriteJSONStream(httptest.NewRecorder(), http.StatusOK, payload); err == nil {
+		t.Error("WriteJSONStream: error expected, but none received")
+	}
+}
+
+func TestTools_UploadFilesNameGenerator(t *testing.T) {
+	img, err := os.ReadFile("./testdata/cyborg-ape.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var receivedType string
+	testTools := Tools{NameGenerator: func(original string, fileType string) string {
+		receivedType = fileType
+		return "../tenant-7/avatar"
+	}}
+	uploadDir := t.TempDir()
+
+	upload := []testUpload{{field: "file", filename: "me.png", content: img}}
+
+	files, err := testTools.UploadFiles(newUploadRequest(t, upload, nil), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if receivedType != "image/png" {
+		t.Errorf("expected the generator to receive image/png, got %s", receivedType)
+	}
+
+	if files[0].NewFileName != "avatar.png" {
+		t.Errorf("expected the file to be stored as avatar.png, got %s", files[0].NewFileName)
+	}
+
+	if _, err := os.Stat(filepath.Join(uploadDir, "avatar.png")); err != nil {
+		t.Errorf("expected file to exist: %s", err.Error())
+	}
+
+	// a second upload under the same generated name is kept apart
+	files, err = testTools.UploadFiles(newUploadRequest(t, upload, nil), uploadDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !regexp.MustCompile(`^avatar_.{8}\.png$`).MatchString(files[0].NewFileName) {
+		t.Errorf("expected a suffixed name for the colliding upload, got %s", files[0].NewFileName)
+	}
+
+	// keeping the original name ignores the generator
+	files, err = testTools.UploadFiles(newUploadRequest(t, upload, nil), uploadDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if files[0].NewFileName != "me.png" {
+		t.Errorf("expected the original name to be kept, got %s", files[0].NewFileName)
+	}
+}
+
+func TestTools_RateLimitMiddlewareSpoofedForwarding(t *testing.T) {
+	var testTools Tools
+	testTools.RateLimit = RateLimitConfig{Rate: 0.001, Burst: 1}
+
+	handler := testTools.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = "203.0.113.5:40000"
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("198.51.100.%d", i))
+		rr := httptest.NewRecorder()
+
+		handler.ServeHTTP(rr, req)
+		if rr.Code == http.StatusOK {
+			allowed++
+		}
+	}
+
+	if allowed != 1 {
+		t.Errorf("expected a spoofed X-Forwarded-For from an untrusted peer to be ignored, but %d of 20 requests were allowed", allowed)
+	}
+}
+
+func TestTools_SingleflightMiddlewareConcurrentReplay(t *testing.T) {
+	var testTools Tools
+	release := make(chan struct{})
+
+	handler := testTools.SingleflightMiddleware(func(r *http.Request) string {
+		return r.URL.String()
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("Vary", "Accept")
+	}))
+
+	const concurrentRequests = 8
+	recorders := make([]*httptest.ResponseRecorder, concurrentRequests)
+	wg := sync.WaitGroup{}
+
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+
+		go func(rr *httptest.ResponseRecorder) {
+			defer wg.Done()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/empty", nil))
+			// each replayed response owns its header values
+			rr.Header()["Vary"][0] = "changed"
+		}(recorders[i])
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	changed := 0
+	for i, rr := range recorders {
+		if rr.Code != http.StatusOK {
+			t.Errorf("request %d: status set to %d, expected %d", i, rr.Code, http.StatusOK)
+		}
+		if rr.Header().Get("Vary") == "changed" {
+			changed++
+		}
+	}
+
+	if changed != concurrentRequests {
+		t.Errorf("expected every response to have its own headers, %d of %d did", changed, concurrentRequests)
+	}
+}
+
+func TestTools_SingleflightMiddlewarePanic(t *testing.T) {
+	var testTools Tools
+	release := make(chan struct{})
+
+	handler := testTools.SingleflightMiddleware(func(r *http.Request) string {
+		return r.URL.String()
+	})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		panic("handler failed")
+	}))
+
+	const concurrentRequests = 5
+	recorders := make([]*httptest.ResponseRecorder, concurrentRequests)
+	var panics int32
+	wg := sync.WaitGroup{}
+
+	for i := range recorders {
+		recorders[i] = httptest.NewRecorder()
+		wg.Add(1)
+
+		go func(rr *httptest.ResponseRecorder) {
+			defer wg.Done()
+			defer func() {
+				if recover() != nil {
+					atomic.AddInt32(&panics, 1)
+				}
+			}()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/panic", nil))
+		}(recorders[i])
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if panics != 1 {
+		t.Fatalf("expected the panic to reach only the request that ran the handler, got %d", panics)
+	}
+
+	waiters := 0
+	for _, rr := range recorders {
+		if rr.Code == http.StatusInternalServerError {
+			waiters++
+		}
+	}
+
+	if waiters != concurrentRequests-1 {
+		t.Errorf("expected %d waiting requests to receive a 500, got %d", concurrentRequests-1, waiters)
+	}
+}